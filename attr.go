@@ -0,0 +1,225 @@
+package nm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/reusee/paza"
+)
+
+func genValue(node *paza.Node, input *paza.Input) string {
+	text := string(input.Text[node.Start : node.Start+node.Len])
+	switch node.Name {
+	case "single-quoted", "double-quoted", "back-quoted":
+		return unescape(text[1 : len(text)-1])
+	}
+	return text
+}
+
+// unescape drops the backslash before any escaped character
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// genRegex compiles a /pattern/flags literal. flags are any of i, m, s and U,
+// with the same meaning as in regexp/syntax.
+func genRegex(node *paza.Node, input *paza.Input) (*regexp.Regexp, error) {
+	text := string(input.Text[node.Start : node.Start+node.Len])
+	end := strings.LastIndex(text, "/")
+	pattern := strings.Replace(text[1:end], `\/`, `/`, -1)
+	flags := text[end+1:]
+	for _, flag := range flags {
+		if !strings.ContainsRune("imsU", flag) {
+			return nil, newCompileError(input, node, UnsupportedOperator,
+				fmt.Errorf("unknown flag %c", flag))
+		}
+	}
+	if len(flags) > 0 {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, newCompileError(input, node, InvalidRegexp, err)
+	}
+	return re, nil
+}
+
+// matchAttr tests the value of attribute p.Name. an empty AttrOp checks for
+// existence only.
+func (p *Pred) matchAttr(n *Node) bool {
+	v, ok := n.Attr[p.Name]
+	return ok && (p.AttrOp == "" || p.test(v))
+}
+
+// attrExpr returns the predicate as an attribute expression, without
+// brackets, if it only tests attributes
+func (p *Pred) attrExpr() (string, bool) {
+	switch p.Op {
+	case PredAttr:
+		switch p.AttrOp {
+		case "":
+			return p.Name, true
+		case "=~":
+			return p.Name + " =~ " + regexString(p.Value), true
+		}
+		return p.Name + " " + p.AttrOp + " " + quote(p.Value), true
+	case PredNot:
+		if sub := p.Subs[0]; sub.Op == PredAttr && sub.AttrOp == "=" {
+			return sub.Name + " != " + quote(sub.Value), true
+		}
+	case PredAnd, PredOr:
+		sep := " || "
+		if p.Op == PredAnd {
+			sep = " && "
+		}
+		parts := make([]string, len(p.Subs))
+		for i, sub := range p.Subs {
+			part, ok := sub.attrExpr()
+			if !ok {
+				return "", false
+			}
+			if p.Op == PredAnd && sub.Op == PredOr {
+				part = "(" + part + ")"
+			}
+			parts[i] = part
+		}
+		return strings.Join(parts, sep), true
+	}
+	return "", false
+}
+
+// regexString returns the regexp of =~ as a /pattern/flags literal, taking
+// the flags back from the (?flags) genRegex put in front
+func regexString(re string) string {
+	var flags string
+	if strings.HasPrefix(re, "(?") {
+		if end := strings.IndexByte(re, ')'); end > 2 && strings.Trim(re[2:end], "imsU") == "" {
+			flags, re = re[2:end], re[end+1:]
+		}
+	}
+	return "/" + strings.Replace(re, "/", `\/`, -1) + "/" + flags
+}
+
+// quote returns s as a double-quoted value
+func quote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// validAttrOp reports whether op is an attribute operator of Pred. "!=" is
+// compiled to the negation of "=".
+func validAttrOp(op string) bool {
+	switch op {
+	case "=", "~=", "^=", "$=", "*=", "|=", "=~":
+		return true
+	}
+	return false
+}
+
+// test applies the attribute operator to v
+func (p *Pred) test(v string) bool {
+	value := p.Value
+	switch p.AttrOp {
+	case "=":
+		return v == value
+	case "~=": // whitespace-separated word
+		for _, word := range strings.Fields(v) {
+			if word == value {
+				return true
+			}
+		}
+		return false
+	case "^=": // prefix
+		return value != "" && strings.HasPrefix(v, value)
+	case "$=": // suffix
+		return value != "" && strings.HasSuffix(v, value)
+	case "*=": // substring
+		return value != "" && strings.Contains(v, value)
+	case "|=": // exact or followed by a dash, as in lang codes
+		return v == value || strings.HasPrefix(v, value+"-")
+	case "=~":
+		return p.compiled().MatchString(v)
+	}
+	return false
+}
+
+// compiled returns the regexp of =~. that of a predicate built by hand is
+// compiled on first use, panicking if invalid as regexp.MustCompile does.
+func (p *Pred) compiled() *regexp.Regexp {
+	p.reOnce.Do(func() {
+		if p.re == nil {
+			p.re = regexp.MustCompile(p.Value)
+		}
+	})
+	return p.re
+}
+
+// genText returns the predicate of :text(v), :textpart(v) or :contains(v),
+// v being a value or, except for :contains, a regexp
+func genText(node *paza.Node, input *paza.Input) (*Pred, error) {
+	name := strings.TrimSpace(string(input.Text[node.Subs[0].Start+1 : node.Subs[0].Start+node.Subs[0].Len]))
+	name = strings.TrimSuffix(name, "(")
+	arg := node.Subs[1]
+	if arg.Name == "regex" {
+		if name == "contains" {
+			return nil, newCompileError(input, arg, UnsupportedOperator, nil)
+		}
+		re, err := genRegex(arg, input)
+		if err != nil {
+			return nil, err
+		}
+		return &Pred{Op: PredText, Name: name, AttrOp: "=~", Value: re.String(), re: re}, nil
+	}
+	p := &Pred{Op: PredText, Name: name, AttrOp: "=", Value: genValue(arg, input)}
+	if name == "contains" {
+		p.Name, p.AttrOp = "text", "*="
+	}
+	return p, nil
+}
+
+// matchText tests Node.Text for text, and each of Node.TextParts for
+// textpart, matching if any part does
+func (p *Pred) matchText(n *Node) bool {
+	if p.Name == "text" {
+		return p.test(n.Text)
+	}
+	for _, part := range n.TextParts {
+		if p.test(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// textString returns the text predicate in pattern syntax
+func (p *Pred) textString() string {
+	switch {
+	case p.AttrOp == "*=":
+		return ":contains(" + quote(p.Value) + ")"
+	case p.AttrOp == "=~":
+		return ":" + p.Name + "(" + regexString(p.Value) + ")"
+	}
+	return ":" + p.Name + "(" + quote(p.Value) + ")"
+}
+
+// validTextOp reports whether op is an operator of text predicate name
+func validTextOp(name, op string) bool {
+	switch name {
+	case "text":
+		return op == "=" || op == "=~" || op == "*="
+	case "textpart":
+		return op == "=" || op == "=~"
+	}
+	return false
+}
@@ -1,7 +1,7 @@
 package nm
 
 import (
-	"os"
+	"strings"
 
 	"github.com/reusee/paza"
 )
@@ -9,91 +9,203 @@ import (
 var set *paza.Set
 
 func init() {
-	set = paza.NewSet()
+	set = newGrammar(nil)
+}
+
+// newGrammar returns the grammar of patterns. if f is not nil, the tokens
+// record their failures in it, for newSyntaxError.
+func newGrammar(f *failure) *paza.Set {
+	set := paza.NewSet()
+	token := func(what, re string) paza.Parser {
+		return f.track(what, re, set.Regex(re))
+	}
+	namedToken := func(name, what, re string) paza.Parser { // names the node, for genAst
+		return f.track(what, re, set.NamedRegex(name, re))
+	}
+	set.Add("pattern", set.Concat("anchor", "expr"))
+	set.Add("anchor", set.Regex(`((\.\.\.|//)\s*)?`))
 	set.Add("expr", set.OrdChoice(
-		set.NamedConcat("or-expr", "expr", set.NamedRune("or-op", '|'), "simple-expr"),
+		set.NamedConcat("or-expr", "expr", namedToken("or-op", "'|'", `\s*\|\s*`), "simple-expr"),
 		"simple-expr"))
 	set.Add("simple-expr", set.OrdChoice(
-		set.NamedConcat("concat-expr", "simple-expr", set.Regex(`\s+`), "basic-expr"),
+		set.NamedConcat("concat-expr", "simple-expr", "combinator", "basic-expr"),
 		"basic-expr"))
+	set.Add("combinator", token("combinator", `\s*(<\+|<~|[>+~])\s*|\s+`))
 	set.Add("basic-expr", set.OrdChoice(
+		"capture-expr",
 		"star-expr",
 		"plus-expr",
 		"option-expr",
 		"elementary-expr"))
+	set.Add("capture-expr", set.Concat(
+		"elementary-expr", namedToken("as-op", "'as'", `\s+as\s+`), "identifier"))
 	set.Add("star-expr", set.Concat(
-		"elementary-expr", set.NamedRune("star-op", '*')))
+		"elementary-expr", namedToken("star-op", "'*'", `\*`)))
 	set.Add("plus-expr", set.Concat(
-		"elementary-expr", set.NamedRune("plus-op", '+')))
+		"elementary-expr", suffix(namedToken("plus-op", "'+'", `\+`))))
 	set.Add("option-expr", set.Concat(
-		"elementary-expr", set.NamedRune("option-op", '?')))
+		"elementary-expr", namedToken("option-op", "'?'", `\?`)))
 	set.Add("elementary-expr", set.OrdChoice(
-		set.NamedConcat("group-expr", set.NamedRegex("left-paren", `\(`),
-			"expr", set.NamedRegex("right-paren", `\)`)),
 		"predict",
+		set.NamedConcat("group-expr", namedToken("left-paren", "'('", `\(`),
+			"expr", namedToken("right-paren", "')'", `\)`)),
+		namedToken("empty-group", "'('", `\(\s*\)`),
 	))
 
 	set.Add("predict", set.OrdChoice(
-		set.NamedConcat("predict-with-attr",
-			set.NamedRepeat("basic-predicts", 1, -1, "basic-predict"),
-			set.NamedRepeat("option-attr-predict", 0, 1, "attr-predict")),
-		"attr-predict"))
+		set.NamedConcat("intersect-predict", "group-predict",
+			set.NamedRepeat("basic-predicts", 0, -1, "basic-predict")),
+		set.Concat(set.NamedRepeat("basic-predicts", 1, -1, "basic-predict"))))
 	set.Add("basic-predict", set.OrdChoice(
-		"id-predict", "class-predict", "tag-predict"))
+		"id-predict", "class-predict", "not-predict", "text-predict", "pseudo-predict",
+		"bang-predict", "attr-predict", "tag-predict"))
+	set.Add("not-predict", set.Concat(
+		token("':not('", `:not\(\s*`),
+		"predict-alternation",
+		token("')'", `\s*\)`)))
+	set.Add("bang-predict", set.Concat(
+		token("'!'", `!`), set.OrdChoice("group-predict", "basic-predict")))
+	set.Add("group-predict", set.Concat(
+		token("'('", `\(\s*`),
+		"predict-alternation",
+		token("')'", `\s*\)`)))
+	set.Add("predict-alternation", set.OrdChoice(
+		set.NamedConcat("predict-or-expr", "predict-alternation",
+			namedToken("predict-or-op", "'|'", `\s*\|\s*`), "predict"),
+		"predict"))
 	set.Add("attr-predict", set.Concat(
-		set.Regex(`\[`),
+		token("'['", `\[\s*`),
 		set.NamedRepeat("option-attr-expr", 0, 1, "attr-expr"),
-		set.Regex(`\]`)))
-	set.Add("identifier", set.Regex(`[a-zA-Z0-9-_]+`))
-	set.Add("id-predict", set.Concat(set.Rune('#'), "identifier"))
-	set.Add("class-predict", set.Concat(set.Rune('.'), "identifier"))
+		token("']'", `\s*\]`)))
+	set.Add("identifier", token("identifier", `[a-zA-Z0-9-_]+`))
+	set.Add("id-predict", set.Concat(token("'#'", `#`), "identifier"))
+	set.Add("class-predict", set.Concat(token("'.'", `\.`), "identifier"))
 	set.Add("tag-predict", set.Concat("identifier"))
+	set.Add("pseudo-predict", set.Concat(
+		token("':'", `:`),
+		"identifier",
+		set.NamedRepeat("option-pseudo-arg", 0, 1, "pseudo-arg")))
+	set.Add("text-predict", set.Concat(
+		set.NamedRegex("text-pseudo", `:(text|textpart|contains)\(\s*`),
+		set.OrdChoice("regex", "value"),
+		token("')'", `\s*\)`)))
+	set.Add("pseudo-arg", set.Concat(
+		token("'('", `\(\s*`),
+		"nth-expr",
+		token("')'", `\s*\)`)))
+	set.Add("nth-expr", token("nth-expr", `odd|even|[+-]?\d*n(\s*[+-]\s*\d+)?|[+-]?\d+`))
 
 	set.Add("attr-expr", set.OrdChoice(
-		set.NamedConcat("attr-or-expr", "attr-expr", set.NamedRegex("attr-or-op", "||"), "attr-simple-expr"),
+		set.NamedConcat("attr-or-expr", "attr-expr", namedToken("attr-or-op", "'||'", `\s*\|\|\s*`), "attr-simple-expr"),
 		"attr-simple-expr"))
 	set.Add("attr-simple-expr", set.OrdChoice(
-		set.NamedConcat("attr-and-expr", "attr-simple-expr", set.NamedRegex("attr-and-op", "&&"), "attr-basic-expr"),
+		set.NamedConcat("attr-and-expr", "attr-simple-expr", namedToken("attr-and-op", "'&&'", `\s*&&\s*`), "attr-basic-expr"),
 		"attr-basic-expr"))
 	set.Add("attr-basic-expr", set.OrdChoice(
-		set.NamedConcat("attr-group-expr", set.NamedRegex("attr-left-paren", `\(`),
-			"attr-expr", set.NamedRegex("attr-right-paren", `\)`)),
-		"attr-elementary-expr"))
+		set.NamedConcat("attr-group-expr", namedToken("attr-left-paren", "'('", `\(\s*`),
+			"attr-expr", namedToken("attr-right-paren", "')'", `\s*\)`)),
+		"attr-regex-expr",
+		"attr-elementary-expr",
+		"attr-exists-expr"))
+	set.Add("attr-regex-expr", set.Concat(
+		"attr-name", "attr-regex-op", "regex"))
 	set.Add("attr-elementary-expr", set.Concat(
-		"identifier",
-		set.NamedRegex("attr-op", `=|!=|~=`),
-		set.NamedOrdChoice("value",
-			"single-quoted",
-			"double-quoted",
-			"back-quoted",
-			"text")))
+		"attr-name", "attr-op", "value"))
+	set.Add("attr-exists-expr", set.Concat("attr-name"))
+	set.Add("attr-name", token("attr-name", `[a-zA-Z0-9-_:]+`))
+	set.Add("attr-regex-op", token("'=~'", `\s*=~\s*`))
+	set.Add("attr-op", token("attr-op", `\s*(=|!=|~=|\^=|\$=|\*=|\|=)\s*`))
+	set.Add("regex", token("regex", `/(?:[^/\\]|\\.)*/[a-zA-Z]*`))
+	set.Add("value", set.OrdChoice(
+		"single-quoted",
+		"double-quoted",
+		"back-quoted",
+		"text"))
+	set.Add("single-quoted", token("value", `'(?:[^'\\]|\\.)*'`))
+	set.Add("double-quoted", token("value", `"(?:[^"\\]|\\.)*"`))
+	set.Add("back-quoted", token("value", "`(?:[^`\\\\]|\\\\.)*`"))
+	set.Add("text", token("value", `[^\s\[\]()&|'"`+"`"+`~][^\s\[\]()&|'"`+"`"+`]*`))
+	return set
 }
 
-func Compile(code string) Program {
-	input := paza.NewInput([]byte(code))
-	ok, l, node := set.Call("expr", input, 0)
-	if !ok {
-		panic("invalid expression")
+// suffix returns parser failing when an elementary-expr follows, so that in
+// a+b the + is the combinator
+func suffix(parser paza.Parser) paza.Parser {
+	return func(input *paza.Input, start int) (bool, int, *paza.Node) {
+		ok, l, node := parser(input, start)
+		if ok && start+l < len(input.Text) {
+			if b := input.Text[start+l]; strings.IndexByte("([.#:!_-", b) >= 0 || isAlnum(b) {
+				return false, 0, nil
+			}
+		}
+		return ok, l, node
 	}
-	if l != len(code) {
-		node.Dump(os.Stdout, input)
-		panic("invalid expression")
+}
+
+func isAlnum(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
+
+func Compile(code string) (Program, error) {
+	program, err := compile(code)
+	if err != nil {
+		return nil, err
+	}
+	return Optimize(program), nil
+}
+
+// compile returns the program of code before optimization
+func compile(code string) (Program, error) {
+	ast, err := parse(code)
+	if err != nil {
+		return nil, err
+	}
+	//ast.dump(0)
+	var program Program
+	if ast.Unanchored { // match any suffix of the path
+		program = append(program, Inst{Unanchored, nil, 0, 0, ""})
+	}
+	p, err := genProgram(ast, len(program))
+	if err != nil {
+		return nil, err
+	}
+	program = append(program, p...)
+	program = append(program, Inst{Ok, nil, 0, 0, ""})
+	return program, nil
+}
+
+// parse returns the ast of code
+func parse(code string) (*Ast, error) {
+	input := paza.NewInput([]byte(code))
+	ok, l, node := set.Call("pattern", input, 0)
+	if !ok || l != len(code) {
+		return nil, newSyntaxError(code)
 	}
 	node = simplify(node)
 	//node.Dump(os.Stdout, input)
-	ast := genAst(node, input)
-	//ast.dump(0)
-	program := genProgram(ast, 0)
-	program = append(program, Inst{Ok, nil, 0, 0})
+	ast, err := genAst(node.Subs[1], input)
+	if err != nil {
+		return nil, err
+	}
+	ast.Unanchored = node.Subs[0].Len > 0
+	return ast, nil
+}
+
+func MustCompile(code string) Program {
+	program, err := Compile(code)
+	if err != nil {
+		panic(err)
+	}
 	return program
 }
 
 func simplify(node *paza.Node) (ret *paza.Node) {
 	for len(node.Subs) == 1 {
 		sub := node.Subs[0]
-		if node.Start == sub.Start && node.Len == sub.Len {
-			node = sub
+		if node.Start != sub.Start || node.Len != sub.Len {
+			break
 		}
+		node = sub
 	}
 	for i, sub := range node.Subs {
 		node.Subs[i] = simplify(sub)
@@ -102,10 +214,12 @@ func simplify(node *paza.Node) (ret *paza.Node) {
 }
 
 type Ast struct {
-	Op      astOp
-	Left    *Ast
-	Right   *Ast
-	Predict func(*Node) bool
+	Op         astOp
+	Left       *Ast
+	Right      *Ast
+	Predict    *Pred
+	Name       string // capture name of opCapture
+	Unanchored bool   // the pattern starts with ... or //, set on the root
 }
 
 type astOp int
@@ -117,152 +231,307 @@ const (
 	opOr
 	opOption
 	opPlus
+	opDescendant
+	opNextSibling
+	opFollowingSibling
+	opPrevSibling
+	opPrecedingSibling
+	opCapture
 )
 
-func genAst(node *paza.Node, input *paza.Input) *Ast {
+func genAst(node *paza.Node, input *paza.Input) (*Ast, error) {
 	switch node.Name {
 	case "concat-expr":
-		return &Ast{
-			Op:    opConcat,
-			Left:  genAst(node.Subs[0], input),
-			Right: genAst(node.Subs[2], input),
-		}
-	case "predict-with-attr":
-		p1 := genPredict(node.Subs[0], input)
-		p2 := genPredict(node.Subs[1], input)
-		return &Ast{
-			Op: opPredict,
-			Predict: func(node *Node) bool {
-				return p1(node) && p2(node)
-			},
+		var op astOp
+		combinator := node.Subs[1]
+		switch strings.TrimSpace(string(input.Text[combinator.Start : combinator.Start+combinator.Len])) {
+		case ">":
+			op = opConcat
+		case "+":
+			op = opNextSibling
+		case "~":
+			op = opFollowingSibling
+		case "<+":
+			op = opPrevSibling
+		case "<~":
+			op = opPrecedingSibling
+		case "":
+			op = opDescendant
+		default:
+			return nil, newCompileError(input, combinator, UnsupportedOperator, nil)
 		}
+		return genBinaryAst(op, node.Subs[0], node.Subs[2], input)
 	case "star-expr":
-		return &Ast{
-			Op:   opStar,
-			Left: genAst(node.Subs[0], input),
-		}
+		return genUnaryAst(opStar, node.Subs[0], input)
 	case "option-expr":
-		return &Ast{
-			Op:   opOption,
-			Left: genAst(node.Subs[0], input),
-		}
+		return genUnaryAst(opOption, node.Subs[0], input)
 	case "plus-expr":
-		return &Ast{
-			Op:   opPlus,
-			Left: genAst(node.Subs[0], input),
-		}
-	case "attr-predict":
-		p := genPredict(node.Subs[1], input)
-		return &Ast{
-			Op:      opPredict,
-			Predict: p,
-		}
+		return genUnaryAst(opPlus, node.Subs[0], input)
 	case "group-expr":
 		return genAst(node.Subs[1], input)
+	case "empty-group":
+		return nil, newCompileError(input, node, EmptyGroup, nil)
+	case "capture-expr":
+		ast, err := genUnaryAst(opCapture, node.Subs[0], input)
+		if err != nil {
+			return nil, err
+		}
+		name := node.Subs[2]
+		ast.Name = string(input.Text[name.Start : name.Start+name.Len])
+		return ast, nil
 	case "or-expr":
-		return &Ast{
-			Op:    opOr,
-			Left:  genAst(node.Subs[0], input),
-			Right: genAst(node.Subs[2], input),
+		ast, err := genBinaryAst(opOr, node.Subs[0], node.Subs[2], input)
+		if err != nil {
+			return nil, err
+		}
+		if ast.Left.Op == opPredict && ast.Right.Op == opPredict {
+			// alternatives of single steps, test them in one state
+			return &Ast{
+				Op:      opPredict,
+				Predict: &Pred{Op: PredOr, Subs: []*Pred{ast.Left.Predict, ast.Right.Predict}},
+			}, nil
 		}
+		return ast, nil
 	default:
-		panic("not handle parse node " + node.Name)
+		predict, err := genPredict(node, input)
+		if err != nil {
+			return nil, err
+		}
+		return &Ast{
+			Op:      opPredict,
+			Predict: predict,
+		}, nil
 	}
-	return nil
 }
 
-func truePredict(node *Node) bool {
-	return true
+func genUnaryAst(op astOp, left *paza.Node, input *paza.Input) (*Ast, error) {
+	l, err := genAst(left, input)
+	if err != nil {
+		return nil, err
+	}
+	return &Ast{
+		Op:   op,
+		Left: l,
+	}, nil
 }
 
-func genPredict(node *paza.Node, input *paza.Input) func(node *Node) bool {
+func genBinaryAst(op astOp, left, right *paza.Node, input *paza.Input) (*Ast, error) {
+	l, err := genAst(left, input)
+	if err != nil {
+		return nil, err
+	}
+	r, err := genAst(right, input)
+	if err != nil {
+		return nil, err
+	}
+	return &Ast{
+		Op:    op,
+		Left:  l,
+		Right: r,
+	}, nil
+}
+
+func genPredict(node *paza.Node, input *paza.Input) (*Pred, error) {
 	switch node.Name {
 	case "identifier": // tag
-		tag := string(input.Text[node.Start : node.Start+node.Len])
-		return func(n *Node) bool {
-			return n.Tag == tag
-		}
-	case "option-attr-predict", "option-attr-expr":
+		return &Pred{Op: PredTag, Name: string(input.Text[node.Start : node.Start+node.Len])}, nil
+	case "option-attr-expr":
 		if len(node.Subs) > 0 {
 			return genPredict(node.Subs[0], input)
 		} else {
-			return truePredict
+			return &Pred{Op: PredAny}, nil
 		}
 	case "basic-predicts":
-		var predicts []func(*Node) bool
+		var predicts []*Pred
 		for _, sub := range node.Subs {
-			predicts = append(predicts, genPredict(sub, input))
-		}
-		return func(n *Node) bool {
-			for _, predict := range predicts {
-				if !predict(n) {
-					return false
-				}
+			predict, err := genPredict(sub, input)
+			if err != nil {
+				return nil, err
 			}
-			return true
+			predicts = append(predicts, predict)
 		}
-	case "id-predict":
-		id := string(input.Text[node.Start+1 : node.Start+node.Len])
-		return func(n *Node) bool {
-			return n.Id == id
+		if len(predicts) == 1 {
+			return predicts[0], nil
 		}
+		return &Pred{Op: PredAnd, Subs: predicts}, nil
+	case "id-predict":
+		return &Pred{Op: PredId, Name: string(input.Text[node.Start+1 : node.Start+node.Len])}, nil
 	case "class-predict":
-		class := string(input.Text[node.Start+1 : node.Start+node.Len])
-		return func(n *Node) bool {
-			for _, cls := range n.Class {
-				if cls == class {
-					return true
-				}
-			}
-			return false
+		return &Pred{Op: PredClass, Name: string(input.Text[node.Start+1 : node.Start+node.Len])}, nil
+	case "not-predict", "bang-predict":
+		p, err := genPredict(node.Subs[1], input)
+		if err != nil {
+			return nil, err
+		}
+		return &Pred{Op: PredNot, Subs: []*Pred{p}}, nil
+	case "group-predict":
+		return genPredict(node.Subs[1], input)
+	case "intersect-predict":
+		if node.Subs[1].Len == 0 { // a group-predict alone
+			return genPredict(node.Subs[0], input)
+		}
+		return genPredicts(PredAnd, node.Subs[0], node.Subs[1], input)
+	case "predict-or-expr":
+		return genPredicts(PredOr, node.Subs[0], node.Subs[2], input)
+	case "text-predict":
+		return genText(node, input)
+	case "pseudo-predict":
+		name := string(input.Text[node.Subs[1].Start : node.Subs[1].Start+node.Subs[1].Len])
+		arg := ""
+		if option := node.Subs[2]; option.Len > 0 {
+			arg = strings.TrimSpace(string(input.Text[option.Start+1 : option.Start+option.Len-1]))
+		}
+		p, err := genPseudo(name, arg)
+		if err != nil {
+			return nil, newCompileError(input, node.Subs[2], InvalidArgument, err)
 		}
+		if p == nil {
+			return nil, newCompileError(input, node, UnknownConstruct, nil)
+		}
+		return p, nil
+	case "attr-predict":
+		return genPredict(node.Subs[1], input)
+	case "attr-group-expr":
+		return genPredict(node.Subs[1], input)
+	case "attr-and-expr":
+		return genPredicts(PredAnd, node.Subs[0], node.Subs[2], input)
+	case "attr-or-expr":
+		return genPredicts(PredOr, node.Subs[0], node.Subs[2], input)
+	case "attr-elementary-expr":
+		key := string(input.Text[node.Subs[0].Start : node.Subs[0].Start+node.Subs[0].Len])
+		op := strings.TrimSpace(string(input.Text[node.Subs[1].Start : node.Subs[1].Start+node.Subs[1].Len]))
+		p := &Pred{Op: PredAttr, Name: key, AttrOp: op, Value: genValue(node.Subs[2], input)}
+		if op == "!=" {
+			p.AttrOp = "="
+			return &Pred{Op: PredNot, Subs: []*Pred{p}}, nil
+		}
+		if !validAttrOp(op) {
+			return nil, newCompileError(input, node.Subs[1], UnsupportedOperator, nil)
+		}
+		return p, nil
+	case "attr-regex-expr":
+		key := string(input.Text[node.Subs[0].Start : node.Subs[0].Start+node.Subs[0].Len])
+		re, err := genRegex(node.Subs[2], input)
+		if err != nil {
+			return nil, err
+		}
+		return &Pred{Op: PredAttr, Name: key, AttrOp: "=~", Value: re.String(), re: re}, nil
+	case "attr-name": // existence
+		return &Pred{Op: PredAttr, Name: string(input.Text[node.Start : node.Start+node.Len])}, nil
 	default:
-		panic("not handle predict node " + node.Name)
+		return nil, newCompileError(input, node, UnknownConstruct, nil)
+	}
+}
+
+// genPredicts returns the PredAnd or PredOr of two predicates
+func genPredicts(op PredOp, left, right *paza.Node, input *paza.Input) (*Pred, error) {
+	p1, err := genPredict(left, input)
+	if err != nil {
+		return nil, err
+	}
+	p2, err := genPredict(right, input)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return &Pred{Op: op, Subs: []*Pred{p1, p2}}, nil
 }
 
-func genProgram(ast *Ast, baseAddr int) Program {
+func genProgram(ast *Ast, baseAddr int) (Program, error) {
 	switch ast.Op {
 	case opConcat:
-		p1 := genProgram(ast.Left, baseAddr)
-		p2 := genProgram(ast.Right, baseAddr+len(p1))
-		return append(p1, p2...)
+		p1, err := genProgram(ast.Left, baseAddr)
+		if err != nil {
+			return nil, err
+		}
+		p2, err := genProgram(ast.Right, baseAddr+len(p1))
+		if err != nil {
+			return nil, err
+		}
+		return append(p1, p2...), nil
+	case opDescendant, opNextSibling, opFollowingSibling, opPrevSibling, opPrecedingSibling:
+		var op Op
+		switch ast.Op {
+		case opDescendant:
+			op = Descend
+		case opNextSibling:
+			op = NextSibling
+		case opFollowingSibling:
+			op = FollowingSibling
+		case opPrevSibling:
+			op = PrevSibling
+		case opPrecedingSibling:
+			op = PrecedingSibling
+		}
+		p1, err := genProgram(ast.Left, baseAddr)
+		if err != nil {
+			return nil, err
+		}
+		p1 = append(p1, Inst{op, nil, 0, 0, ""})
+		p2, err := genProgram(ast.Right, baseAddr+len(p1))
+		if err != nil {
+			return nil, err
+		}
+		return append(p1, p2...), nil
 	case opPredict:
 		return []Inst{
-			{Predict, ast.Predict, 0, 0},
-		}
+			{Predict, ast.Predict, 0, 0, ""},
+		}, nil
 	case opStar:
-		ep := genProgram(ast.Left, baseAddr+1)
+		ep, err := genProgram(ast.Left, baseAddr+1)
+		if err != nil {
+			return nil, err
+		}
 		p := []Inst{
-			{Split, nil, baseAddr + 1, baseAddr + 1 + len(ep) + 1},
+			{Split, nil, baseAddr + 1, baseAddr + 1 + len(ep) + 1, ""},
 		}
 		p = append(p, ep...)
-		p = append(p, Inst{Jump, nil, baseAddr, 0})
-		return p
+		p = append(p, Inst{Jump, nil, baseAddr, 0, ""})
+		return p, nil
 	case opOption:
-		ep := genProgram(ast.Left, baseAddr+1)
+		ep, err := genProgram(ast.Left, baseAddr+1)
+		if err != nil {
+			return nil, err
+		}
 		p := []Inst{
-			{Split, nil, baseAddr + 1, baseAddr + 1 + len(ep)},
+			{Split, nil, baseAddr + 1, baseAddr + 1 + len(ep), ""},
 		}
 		p = append(p, ep...)
-		return p
+		return p, nil
 	case opPlus:
-		p := genProgram(ast.Left, baseAddr)
-		p = append(p, Inst{Split, nil, baseAddr, baseAddr + len(p) + 1})
-		return p
+		p, err := genProgram(ast.Left, baseAddr)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, Inst{Split, nil, baseAddr, baseAddr + len(p) + 1, ""})
+		return p, nil
 	case opOr:
-		p1 := genProgram(ast.Left, baseAddr+1)
-		p2 := genProgram(ast.Right, baseAddr+1+len(p1)+1)
+		p1, err := genProgram(ast.Left, baseAddr+1)
+		if err != nil {
+			return nil, err
+		}
+		p2, err := genProgram(ast.Right, baseAddr+1+len(p1)+1)
+		if err != nil {
+			return nil, err
+		}
 		p := []Inst{
-			{Split, nil, baseAddr + 1, baseAddr + 1 + len(p1) + 1},
+			{Split, nil, baseAddr + 1, baseAddr + 1 + len(p1) + 1, ""},
 		}
 		p = append(p, p1...)
-		p = append(p, Inst{Jump, nil, baseAddr + 1 + len(p1) + 1 + len(p2), 0})
+		p = append(p, Inst{Jump, nil, baseAddr + 1 + len(p1) + 1 + len(p2), 0, ""})
 		p = append(p, p2...)
-		return p
+		return p, nil
+	case opCapture:
+		p, err := genProgram(ast.Left, baseAddr)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, Inst{Save, nil, 0, 0, ast.Name})
+		return p, nil
 	default:
-		panic("not handled ast Op " + ast.Op.String())
+		return nil, &CompileError{
+			Offset:    -1,
+			Kind:      UnknownConstruct,
+			Construct: ast.Op.String(),
+		}
 	}
-	return nil
 }
@@ -1,6 +1,11 @@
 package nm
 
-import "testing"
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
 
 func _TestCompile(t *testing.T) { //TODO
 	codes := []string{
@@ -10,10 +15,269 @@ func _TestCompile(t *testing.T) { //TODO
 		//`html body div#foo div.bar ul li p a []*`,
 	}
 	for _, code := range codes {
-		program := Compile(code)
-		for _, inst := range program {
-			pt("%v\n", inst)
+		pt("%s\n", MustCompile(code))
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	cases := []struct {
+		code     string
+		offset   int
+		line     int
+		column   int
+		expected string
+	}{
+		{``, 0, 1, 1, "'!', '#', '(', '.', ':', ':not(', '[', identifier"},
+		{`)`, 0, 1, 1, "'!', '#', '(', '.', ':', ':not(', '[', identifier"},
+		{`a b |`, 5, 1, 6, "'!', '#', '(', '.', ':', ':not(', '[', identifier"},
+		{`a (b c`, 6, 1, 7, "'!', '#', ')', '*', '+', '.', ':', ':not(', '?', '[', 'as', '|', combinator, identifier"},
+		{`a[href=]`, 7, 1, 8, "value"},
+		{`a[href!]`, 6, 1, 7, "'&&', '=~', ']', '||', attr-op"},
+		{`a[href=1 && ]`, 12, 1, 13, "'(', attr-name"},
+		{`a[href=~foo]`, 8, 1, 9, "regex"},
+		{`a[(href=1 || rel=2]`, 18, 1, 19, "'&&', ')', '||'"},
+		{`a[href=1`, 8, 1, 9, "'&&', ']', '||'"},
+		{`div.`, 4, 1, 5, "identifier"},
+		{`div)`, 3, 1, 4, "'!', '#', '*', '+', '.', ':', ':not(', '?', '[', 'as', '|', combinator, identifier"},
+		{`li:`, 3, 1, 4, "identifier"},
+		{`li:nth(x)`, 7, 1, 8, "nth-expr"},
+		{`li:nth(2n+1`, 11, 1, 12, "')'"},
+		{`div:not(`, 8, 1, 9, "'!', '#', '(', '.', ':', ':not(', '[', identifier, nth-expr"},
+		{`div:not(.ad`, 11, 1, 12, "'!', '#', ')', '.', ':', ':not(', '[', '|', identifier"},
+		{`div!`, 4, 1, 5, "'!', '#', '(', '.', ':', ':not(', '[', identifier"},
+		{`... a b[`, 8, 1, 9, "'(', ']', attr-name"},
+		{`//`, 2, 1, 3, "'!', '#', '(', '.', ':', ':not(', '[', identifier"},
+		{`a > `, 4, 1, 5, "'!', '#', '(', '.', ':', ':not(', '[', identifier"},
+		{`a>b ~`, 5, 1, 6, "'!', '#', '(', '.', ':', ':not(', '[', identifier"},
+		{`a + )`, 4, 1, 5, "'!', '#', '(', '.', ':', ':not(', '[', identifier"},
+		{`a <~ `, 5, 1, 6, "'!', '#', '(', '.', ':', ':not(', '[', identifier"},
+		{"html\nbody\n  [x=", 15, 3, 6, "value"},
+		{`a[x="é"] b[x=`, 14, 1, 14, "value"},
+	}
+	for _, c := range cases {
+		_, err := Compile(c.code)
+		e, ok := err.(*SyntaxError)
+		if !ok {
+			t.Fatalf("%q: expecting SyntaxError, got %v", c.code, err)
 		}
-		pt("\n")
+		expected := strings.Join(e.Expected, ", ")
+		if e.Offset != c.offset || e.Line != c.line || e.Column != c.column || expected != c.expected {
+			t.Fatalf("%q: got offset %d line %d column %d expected %s",
+				c.code, e.Offset, e.Line, e.Column, expected)
+		}
+	}
+
+	_, err := Compile("div\n\tp[href=1")
+	if err == nil || err.Error() != "invalid expression at line 2 column 10: expected one of '&&', ']', '||'\n\tp[href=1\n\t        ^" {
+		t.Fatalf("error message: %v", err)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	expected := `   0  Unanchored
+   1  Predict          ul
+   2  Descend
+   3  Split            4, 10
+   4  Split            5, 7
+   5  Predict          li.a[href ^= "x"]
+   6  Split            4, 10
+   7  Predict          li
+   8  Save             item
+   9  Split            4, 10
+  10  Ok
+`
+	program := MustCompile(`... ul (li.a[href^=x] | li as item)*`)
+	if program.String() != expected {
+		t.Fatalf("got\n%s", program)
+	}
+}
+
+func TestAstString(t *testing.T) {
+	cases := []struct {
+		code, str string
+	}{
+		{`html>body div`, `html > body div`},
+		{`a | b c | d`, `a | b c | d`},
+		{`a | (b | c)`, `a | (b | c)`},
+		{`... a`, `... a`},
+		{`//a > (b | c)`, `... a > (b | c)`},
+		{`(a | b c) > d`, `(a | b c) > d`},
+		{`a + (b ~ c)`, `a + (b ~ c)`},
+		{`(a b)* c+ d?`, `(a b)* c+ d?`},
+		{`a+b~c>d<+e<~f`, `a + b ~ c > d <+ e <~ f`},
+		{`a+ b+.x+[y]`, `a+ b + .x + [y]`},
+		{`table tr as row (td:nth(2) as price)`, `table tr as row td:nth(2) as price`},
+		{`(a > b as x)*`, `(a > b as x)*`},
+		{`div.x#y:first:not(.ad)![href]`, `div.x#y:first:not(.ad):not([href])`},
+		{`li:not(.ad | #x)`, `li:not(.ad | #x)`},
+		{`(a|p.x)[title]`, `(a | p.x)[title]`},
+		{`(a|b)+ (a|b) as x`, `(a | b)+ (a | b) as x`},
+		{`li:nth-last( -2n + 3 ):nth(odd):nth(4)`, `li:nth-last(-2n+3):nth(2n+1):nth(4)`},
+		{`a[x='it"s' && (y!=2 || z=~/a\/b/i)]`, `a[x = "it\"s" && (y != "2" || z =~ /a\/b/i)]`},
+		{`[x || y][z]`, `[(x || y) && z]`},
+		{`:contains(foo) <+ [] <~ dd`, `:contains("foo") <+ [] <~ dd`},
+		{`:text( 'a' ):textpart(/b/)`, `:text("a"):textpart(/b/)`},
+		{`(a)b.x`, `(a)b.x`},
+		{`a as (b)`, `a (as) b`},
+		{`a (as) as b c`, `a (as) as b c`},
+		{`(a | b)[x]c.y`, `(a | b)[x]c.y`},
+	}
+	for _, c := range cases {
+		ast, err := parse(c.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		str := ast.String()
+		if str != c.str {
+			t.Fatalf("%s: got %s", c.code, str)
+		}
+		ast2, err := parse(str)
+		if err != nil {
+			t.Fatalf("%s: %v", str, err)
+		}
+		if ast2.String() != str {
+			t.Fatalf("%s: round trip got %s", str, ast2.String())
+		}
+		if MustCompile(str).String() != MustCompile(c.code).String() {
+			t.Fatalf("%s: program of %s differs", c.code, str)
+		}
+	}
+
+	// intersections built by hand
+	for _, c := range []struct {
+		pred *Pred
+		str  string
+	}{
+		{&Pred{Op: PredAnd, Subs: []*Pred{{Op: PredClass, Name: "x"}, {Op: PredTag, Name: "a"}}}, `(.x)a`},
+		{&Pred{Op: PredAnd, Subs: []*Pred{{Op: PredAny}, {Op: PredTag, Name: "a"}}}, `a`},
+		{&Pred{Op: PredAnd, Subs: []*Pred{{Op: PredAny}}}, `[]`},
+		{&Pred{Op: PredAnd, Subs: []*Pred{
+			{Op: PredOr, Subs: []*Pred{{Op: PredTag, Name: "a"}, {Op: PredTag, Name: "b"}}},
+			{Op: PredOr, Subs: []*Pred{{Op: PredTag, Name: "c"}, {Op: PredTag, Name: "d"}}},
+		}}, `(a | b):not(:not(c | d))`},
+	} {
+		if str := c.pred.String(); str != c.str {
+			t.Fatalf("got %s, want %s", str, c.str)
+		}
+	}
+}
+
+func TestGroupPredicate(t *testing.T) {
+	// a group alone compiles to its content, not to its intersection with []
+	cases := []struct {
+		code, pred string
+	}{
+		{`(a)`, `PredTag a`},
+		{`(a | b)`, `PredOr (PredTag a, PredTag b)`},
+		{`((a | b))`, `PredOr (PredTag a, PredTag b)`},
+		{`(a | b).x`, `PredAnd (PredOr (PredTag a, PredTag b), PredClass x)`},
+		{`(a).x[y]`, `PredAnd (PredTag a, PredAnd (PredClass x, PredAttr y))`},
+		{`!(a | b)`, `PredNot (PredOr (PredTag a, PredTag b))`},
 	}
+	var format func(p *Pred) string
+	format = func(p *Pred) string {
+		if len(p.Subs) == 0 {
+			return p.Op.String() + " " + p.Name
+		}
+		subs := make([]string, len(p.Subs))
+		for i, sub := range p.Subs {
+			subs[i] = format(sub)
+		}
+		return p.Op.String() + " (" + strings.Join(subs, ", ") + ")"
+	}
+	for _, c := range cases {
+		program, err := compile(c.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := format(program[0].Predict); got != c.pred {
+			t.Fatalf("%s: got %s", c.code, got)
+		}
+	}
+}
+
+func TestMustCompile(t *testing.T) {
+	defer func() {
+		if _, ok := recover().(*SyntaxError); !ok {
+			t.Fatal("expecting SyntaxError panic")
+		}
+	}()
+	MustCompile(`a[`)
+}
+
+func TestCompileErrorKind(t *testing.T) {
+	cases := []struct {
+		code      string
+		offset    int
+		kind      ErrorKind
+		construct string
+	}{
+		{`li:foo`, 2, UnknownConstruct, ":foo"},
+		{`li:first(2)`, 2, UnknownConstruct, ":first(2)"},
+		{`div:not(:bar)`, 8, UnknownConstruct, ":bar"},
+		{`a[href=~/x/g]`, 8, UnsupportedOperator, "/x/g"},
+		{`a[href=~/(/]`, 8, InvalidRegexp, "/(/"},
+		{`li:nth(99999999999999999999)`, 6, InvalidArgument, "(99999999999999999999)"},
+		{`li:nth-last(99999999999999999999n+1)`, 11, InvalidArgument, "(99999999999999999999n+1)"},
+		{`li:nth( 2n + 99999999999999999999 )`, 6, InvalidArgument, "( 2n + 99999999999999999999 )"},
+		{`div ()`, 4, EmptyGroup, "()"},
+		{`div > ( ) p`, 6, EmptyGroup, "( )"},
+	}
+	for _, c := range cases {
+		_, err := Compile(c.code)
+		e, ok := err.(*CompileError)
+		if !ok {
+			t.Fatalf("%q: expecting CompileError, got %v", c.code, err)
+		}
+		if e.Offset != c.offset || e.Kind != c.kind || e.Construct != c.construct {
+			t.Fatalf("%q: got offset %d kind %v construct %q", c.code, e.Offset, e.Kind, e.Construct)
+		}
+	}
+
+	_, err := Compile("div\n\tli:foo")
+	if err == nil || err.Error() != "invalid expression at line 2 column 4: unknown construct \":foo\"\n\tli:foo\n\t  ^" {
+		t.Fatalf("error message: %v", err)
+	}
+
+	_, err = Compile("li:nth(99999999999999999999)")
+	if e, ok := err.(*CompileError); !ok || !errors.Is(e.Err, strconv.ErrRange) {
+		t.Fatalf("nth out of range: %v", err)
+	}
+}
+
+func FuzzCompile(f *testing.F) {
+	for _, code := range []string{
+		`html > body > div`,
+		`... a.next[href^=http && !rel]`,
+		`table tr as row td:nth(2n+1) <~ td`,
+		`ul > li:not(.ad | #x):text(/a\/b/i)`,
+		`(a|b)* c? d+ + e ~ f`,
+		`a[x="q\"" || (y != 'z')]`,
+	} {
+		f.Add(code)
+	}
+	f.Fuzz(func(t *testing.T, code string) {
+		program, err := Compile(code)
+		if err != nil {
+			if err.Error() == "" { // formatting must not panic either
+				t.Fatal("empty message")
+			}
+		} else if len(program) == 0 {
+			t.Fatal("empty program")
+		}
+		if ast, err := parse(code); err == nil {
+			str := ast.String()
+			ast2, err := parse(str)
+			if err != nil {
+				t.Fatalf("%q printed as %q: %v", code, str, err)
+			}
+			if ast2.String() != str {
+				t.Fatalf("%q printed as %q, then %q", code, str, ast2.String())
+			}
+			if program2, err := Compile(str); (err == nil) != (program != nil) ||
+				err == nil && program2.String() != program.String() {
+				t.Fatalf("%q printed as %q, compiling to another program", code, str)
+			}
+		}
+	})
 }
@@ -0,0 +1,257 @@
+package nm
+
+import (
+	"sort"
+	"sync"
+)
+
+// DefaultDFABudget is the memory budget of a DFA created with budget 0
+const DefaultDFABudget = 1 << 20
+
+// DFA runs a program as a deterministic automaton built lazily, in the
+// manner of RE2. a state is the set of threads of the program after a
+// node, and its transitions are keyed by the signature of the next node:
+// the results of the predicates the state tests. nodes with the same
+// results, like those of repeated tag and class combinations, reuse the
+// transitions. states are computed in the scratch space of each match and
+// only published to the cache under its lock. when the cache reaches its
+// memory budget, the NFA runs what is missing from it, without locking. a
+// DFA is safe for concurrent use.
+type DFA struct {
+	program    Program
+	unanchored bool
+	siblings   bool    // sibling steps need the NFA on trees
+	preds      []*Pred // distinct predicates of the program
+	predOf     []int   // index in preds of the predicate of each Predict
+
+	mu     sync.RWMutex // guards the fields below and the next of the states
+	budget int
+	used   int
+	full   bool                 // no state or transition fits anymore
+	states map[string]*dfaState // by pcs
+	start  *dfaState
+}
+
+type dfaState struct {
+	pcs   []int // closed threads, sorted
+	preds []int // predicates tested by the threads, signature order
+	ok    bool  // a thread reached Ok
+	key   string
+	next  map[string]*dfaState
+}
+
+// dfaRun is the scratch space of one match, so that computing states needs
+// no lock and the NFA can take over when the cache is full
+type dfaRun struct {
+	d *DFA
+	m *matcher
+}
+
+func (r *dfaRun) matcher() *matcher {
+	if r.m == nil {
+		r.m = newMatcher(r.d.program, false)
+	}
+	return r.m
+}
+
+// threads returns the thread set holding the pcs of s
+func (r *dfaRun) threads(s *dfaState) *_Threads {
+	m := r.matcher()
+	in := m.threadsAt(&m.states, 0)
+	for _, pc := range s.pcs {
+		in.add(pc)
+	}
+	return in
+}
+
+// NewDFA returns a DFA of program using at most budget bytes for its
+// cache, or DefaultDFABudget if budget is 0
+func NewDFA(program Program, budget int) *DFA {
+	if budget <= 0 {
+		budget = DefaultDFABudget
+	}
+	d := &DFA{
+		program:    program,
+		unanchored: len(program) > 0 && program[0].Op == Unanchored,
+		predOf:     make([]int, len(program)),
+		budget:     budget,
+		states:     make(map[string]*dfaState),
+	}
+	for pc, inst := range program {
+		switch inst.Op {
+		case Predict:
+			d.predOf[pc] = -1
+			for i, pred := range d.preds {
+				if pred.equal(inst.Predict) {
+					d.predOf[pc] = i
+				}
+			}
+			if d.predOf[pc] < 0 {
+				d.predOf[pc] = len(d.preds)
+				d.preds = append(d.preds, inst.Predict)
+			}
+		case NextSibling, FollowingSibling, PrevSibling, PrecedingSibling:
+			d.siblings = true
+		}
+	}
+	m := newMatcher(program, false)
+	start := m.states[0]
+	d.start = d.newState(start, m.closure(start, 0, nil) >= 0)
+	d.states[d.start.key] = d.start // the start state is kept whatever the budget
+	d.used = d.start.size()
+	return d
+}
+
+// Match reports whether the whole path matches, like Program.Match
+func (d *DFA) Match(path []*Node) bool {
+	r := &dfaRun{d: d}
+	s := d.start
+	for i, node := range path {
+		next := r.step(s, node)
+		if next == nil { // cache full, the NFA runs the rest
+			return r.matcher().matchPath(r.threads(s), s.ok, path[i:])
+		}
+		s = next
+	}
+	return s.ok
+}
+
+// MatchTree returns the nodes matched in the tree rooted at node, like
+// Match. programs with sibling steps are run by the NFA.
+func (d *DFA) MatchTree(node *Node) []*Node {
+	if d.siblings {
+		return Match(node, d.program)
+	}
+	r := &dfaRun{d: d}
+	var ret []*Node
+	var walk func(s *dfaState, node *Node)
+	walk = func(s *dfaState, node *Node) {
+		next := r.step(s, node)
+		if next == nil { // cache full, the NFA runs the subtree
+			m := r.matcher()
+			r.threads(s) // the threads before node, at depth 0
+			m.walk(node, 0)
+			ret = append(ret, m.result...)
+			m.result = m.result[:0]
+			return
+		}
+		if next.ok {
+			ret = append(ret, node)
+		}
+		if len(next.pcs) == 0 && !d.unanchored { // all threads dead
+			return
+		}
+		for _, child := range node.Children {
+			walk(next, child)
+		}
+	}
+	walk(d.start, node)
+	return ret
+}
+
+// step returns the state after node, or nil if it is not cached and the
+// cache is full
+func (r *dfaRun) step(s *dfaState, node *Node) *dfaState {
+	d := r.d
+	var buf [64]byte
+	sig := buf[:0]
+	if n := (len(s.preds) + 7) / 8; n > len(buf) {
+		sig = make([]byte, 0, n)
+	}
+	var bits byte
+	for i, pred := range s.preds {
+		if d.preds[pred].Match(node) {
+			bits |= 1 << uint(i%8)
+		}
+		if i%8 == 7 || i == len(s.preds)-1 {
+			sig = append(sig, bits)
+			bits = 0
+		}
+	}
+	d.mu.RLock()
+	next, ok := s.next[string(sig)]
+	full := d.full
+	d.mu.RUnlock()
+	if ok {
+		return next
+	}
+	if full {
+		return nil
+	}
+
+	m := r.matcher()
+	out := m.threadsAt(&m.afters, 0)
+	m.step(r.threads(s), 0, out, node)
+	matched := m.closure(out, 0, node) >= 0
+	if d.unanchored {
+		from := out.n
+		out.add(0)
+		m.closure(out, from, node)
+	}
+	return d.publish(s, string(sig), d.newState(out, matched))
+}
+
+// newState returns the state of the closed threads t, not cached yet
+func (d *DFA) newState(t *_Threads, ok bool) *dfaState {
+	pcs := make([]int, t.n)
+	copy(pcs, t.dense[:t.n])
+	sort.Ints(pcs)
+	key := make([]byte, 0, len(pcs)*4+1)
+	if ok {
+		key = append(key, 1)
+	} else {
+		key = append(key, 0)
+	}
+	for _, pc := range pcs {
+		key = append(key, byte(pc), byte(pc>>8), byte(pc>>16), byte(pc>>24))
+	}
+	s := &dfaState{
+		pcs:  pcs,
+		ok:   ok,
+		key:  string(key),
+		next: make(map[string]*dfaState),
+	}
+	for _, pc := range pcs {
+		if d.program[pc].Op != Predict {
+			continue
+		}
+		pred, seen := d.predOf[pc], false
+		for _, p := range s.preds {
+			seen = seen || p == pred
+		}
+		if !seen {
+			s.preds = append(s.preds, pred)
+		}
+	}
+	return s
+}
+
+func (s *dfaState) size() int {
+	return 64 + len(s.key) + 8*len(s.pcs) + 8*len(s.preds)
+}
+
+// publish caches next as the state after s for nodes of signature sig, and
+// returns the cached state, or nil if the cache is full
+func (d *DFA) publish(s *dfaState, sig string, next *dfaState) *dfaState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if cached, ok := s.next[sig]; ok { // published meanwhile
+		return cached
+	}
+	size := len(sig) + 48
+	cached, ok := d.states[next.key]
+	if !ok {
+		size += next.size()
+	}
+	if d.used+size > d.budget {
+		d.full = true
+		return nil
+	}
+	if !ok {
+		d.states[next.key] = next
+		cached = next
+	}
+	s.next[sig] = cached
+	d.used += size
+	return cached
+}
@@ -0,0 +1,100 @@
+package nm
+
+import (
+	"sync"
+	"testing"
+)
+
+var dfaCodes = []string{
+	`ROOT div`,
+	`ROOT []* a`,
+	`ROOT (div|p)+ a.even`,
+	`ROOT div? p []* a`,
+	`ROOT (div|p)* a`,
+	`... p a`,
+	`... .even .even .even`,
+	`... div (p|a)+ a.even`,
+	`// div []*`,
+	`ROOT div as d p`,
+	`ROOT div + p`,
+	`ROOT > div > p <~ div`,
+}
+
+func TestDFA(t *testing.T) {
+	root := genTree(6, 4)
+	for _, budget := range []int{0, 1000, 1} {
+		for _, code := range dfaCodes {
+			program := MustCompile(code)
+			dfa := NewDFA(program, budget)
+			var walk func(node *Node, path []*Node)
+			walk = func(node *Node, path []*Node) {
+				path = append(path[:len(path):len(path)], node)
+				if dfa.Match(path) != program.Match(path) {
+					t.Fatalf("%s: budget %d: path of %v differs", code, budget, node.TagPath())
+				}
+				for _, c := range node.Children {
+					walk(c, path)
+				}
+			}
+			walk(root, nil)
+			want, got := Match(root, program), dfa.MatchTree(root)
+			if len(got) != len(want) {
+				t.Fatalf("%s: budget %d: got %d expected %d", code, budget, len(got), len(want))
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("%s: budget %d: result %d not match", code, budget, i)
+				}
+			}
+			if dfa.used > dfa.budget && len(dfa.states) > 1 { // the start state is always kept
+				t.Fatalf("%s: %d bytes used over %d", code, dfa.used, dfa.budget)
+			}
+		}
+	}
+}
+
+func TestDFAFull(t *testing.T) {
+	// with the cache full, the NFA runs in the scratch space of the call
+	root := genTree(6, 4)
+	program := MustCompile(`... div (p|a)+ a.even`)
+	want := len(Match(root, program))
+	dfa := NewDFA(program, 1)
+	allocs := testing.AllocsPerRun(10, func() {
+		if len(dfa.MatchTree(root)) != want {
+			t.Fatal("match")
+		}
+	})
+	if !dfa.full || len(dfa.states) != 1 {
+		t.Fatal("cache not full")
+	}
+	if allocs > 100 { // the tree has 5461 nodes
+		t.Fatalf("%v allocations", allocs)
+	}
+}
+
+func TestDFAConcurrent(t *testing.T) {
+	root := genTree(5, 4)
+	program := MustCompile(`... div (p|a)+ a.even`)
+	want := len(Match(root, program))
+	dfa := NewDFA(program, 2000)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := len(dfa.MatchTree(root)); got != want {
+				t.Errorf("got %d expected %d", got, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkDFA(b *testing.B) {
+	root := genTree(8, 4)
+	dfa := NewDFA(MustCompile(`... div (p|a)+ a.even`), 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dfa.MatchTree(root)
+	}
+}
@@ -0,0 +1,188 @@
+package nm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/reusee/paza"
+)
+
+// SyntaxError reports a pattern that cannot be parsed
+type SyntaxError struct {
+	Code     string
+	Offset   int      // byte offset of the error
+	Line     int      // 1-based
+	Column   int      // 1-based, in runes
+	Expected []string // the tokens that could follow, sorted
+}
+
+func (e *SyntaxError) Error() string {
+	expected := "end of input"
+	switch len(e.Expected) {
+	case 0:
+	case 1:
+		expected = e.Expected[0]
+	default:
+		expected = "one of " + strings.Join(e.Expected, ", ")
+	}
+	return fmt.Sprintf("invalid expression at line %d column %d: expected %s\n%s",
+		e.Line, e.Column, expected, e.Snippet())
+}
+
+// Snippet returns the line containing the error with a caret under the error column
+func (e *SyntaxError) Snippet() string {
+	return snippet(e.Code, e.Offset)
+}
+
+func snippet(code string, offset int) string {
+	lineStart := strings.LastIndex(code[:offset], "\n") + 1
+	lineEnd := strings.Index(code[offset:], "\n")
+	if lineEnd < 0 {
+		lineEnd = len(code)
+	} else {
+		lineEnd += offset
+	}
+	var caret []rune
+	for _, r := range code[lineStart:offset] {
+		if r == '\t' {
+			caret = append(caret, '\t')
+		} else {
+			caret = append(caret, ' ')
+		}
+	}
+	return code[lineStart:lineEnd] + "\n" + string(caret) + "^"
+}
+
+// lineColumn returns the 1-based line and rune column of offset in code
+func lineColumn(code string, offset int) (line, column int) {
+	lineStart := strings.LastIndex(code[:offset], "\n") + 1
+	return strings.Count(code[:offset], "\n") + 1,
+		utf8.RuneCountInString(code[lineStart:offset]) + 1
+}
+
+// newSyntaxError returns the error of code, which does not parse. code is
+// parsed again by a grammar whose tokens record their failures, and the
+// error is at the farthest failure, where the longest prefix of code that is
+// a prefix of some pattern ends.
+func newSyntaxError(code string) *SyntaxError {
+	f := &failure{offset: -1}
+	newGrammar(f).Call("pattern", paza.NewInput([]byte(code)), 0)
+	if f.offset < 0 { // all of code parsed, something extra would be needed
+		f.offset = len(code)
+	}
+	sort.Strings(f.expected)
+	line, column := lineColumn(code, f.offset)
+	return &SyntaxError{
+		Code:     code,
+		Offset:   f.offset,
+		Line:     line,
+		Column:   column,
+		Expected: f.expected,
+	}
+}
+
+// failure is the farthest offset where a token failed to parse, with the
+// tokens expected there
+type failure struct {
+	offset   int
+	expected []string
+}
+
+// track returns parser, the token of regexp re, recording its failures in f
+// as expecting what. a nil f records nothing.
+func (f *failure) track(what, re string, parser paza.Parser) paza.Parser {
+	if f == nil {
+		return parser
+	}
+	skip := strings.HasPrefix(re, `\s*`)
+	return func(input *paza.Input, start int) (bool, int, *paza.Node) {
+		ok, l, node := parser(input, start)
+		if ok {
+			return ok, l, node
+		}
+		offset := start
+		if skip { // the token failed after the spaces
+			offset = skipSpace(input.Text, start)
+		}
+		switch {
+		case offset > f.offset:
+			f.offset, f.expected = offset, []string{what}
+		case offset == f.offset:
+			for _, e := range f.expected {
+				if e == what {
+					return ok, l, node
+				}
+			}
+			f.expected = append(f.expected, what)
+		}
+		return ok, l, node
+	}
+}
+
+// CompileError reports a pattern that parses but cannot be compiled
+type CompileError struct {
+	Code      string
+	Offset    int // byte offset of Construct, -1 if unknown
+	Kind      ErrorKind
+	Construct string // the offending part of Code
+	Err       error  // the underlying error, if any
+}
+
+type ErrorKind int
+
+const (
+	UnknownConstruct    ErrorKind = iota // like an unknown pseudo class
+	UnsupportedOperator                  // like an unknown regexp flag
+	EmptyGroup                           // ()
+	InvalidRegexp
+	InvalidArgument // like an nth number out of range
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case UnknownConstruct:
+		return "unknown construct"
+	case UnsupportedOperator:
+		return "unsupported operator"
+	case EmptyGroup:
+		return "empty group"
+	case InvalidRegexp:
+		return "invalid regexp"
+	case InvalidArgument:
+		return "invalid argument"
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+func (e *CompileError) Error() string {
+	msg := fmt.Sprintf("%s %q", e.Kind, e.Construct)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	if e.Offset < 0 {
+		return "invalid expression: " + msg
+	}
+	line, column := lineColumn(e.Code, e.Offset)
+	return fmt.Sprintf("invalid expression at line %d column %d: %s\n%s",
+		line, column, msg, snippet(e.Code, e.Offset))
+}
+
+// newCompileError returns a CompileError about node
+func newCompileError(input *paza.Input, node *paza.Node, kind ErrorKind, err error) *CompileError {
+	return &CompileError{
+		Code:      string(input.Text),
+		Offset:    node.Start,
+		Kind:      kind,
+		Construct: string(input.Text[node.Start : node.Start+node.Len]),
+		Err:       err,
+	}
+}
+
+func skipSpace(text []byte, pos int) int {
+	for pos < len(text) && strings.IndexByte(" \t\r\n\f\v", text[pos]) >= 0 {
+		pos++
+	}
+	return pos
+}
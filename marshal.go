@@ -0,0 +1,290 @@
+package nm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// programVersion is the version of the serialized program format, bumped
+// whenever an encoded program would change meaning
+const programVersion = 1
+
+var programMagic = []byte("nm")
+
+// MarshalBinary encodes the program as the magic "nm", the format version
+// and the instructions
+func (p Program) MarshalBinary() ([]byte, error) {
+	e := new(encoder)
+	e.Write(programMagic)
+	e.uvarint(programVersion)
+	e.uvarint(uint64(len(p)))
+	for _, inst := range p {
+		e.uvarint(uint64(inst.Op))
+		e.varint(int64(inst.A))
+		e.varint(int64(inst.B))
+		e.string(inst.Name)
+		if inst.Predict == nil {
+			e.WriteByte(0)
+		} else {
+			e.WriteByte(1)
+			e.pred(inst.Predict)
+		}
+	}
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a program encoded by MarshalBinary
+func (p *Program) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, programMagic) {
+		return errors.New("not an encoded program")
+	}
+	d := &decoder{data: data[len(programMagic):]}
+	if version := d.uvarint(); d.err == nil && version != programVersion {
+		return fmt.Errorf("unsupported program version %d", version)
+	}
+	n := d.uvarint()
+	if n > uint64(len(d.data)) { // each instruction takes some bytes
+		return errors.New("invalid program length")
+	}
+	program := make(Program, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		inst := Inst{
+			Op:   Op(d.uvarint()),
+			A:    int(d.varint()),
+			B:    int(d.varint()),
+			Name: d.string(),
+		}
+		if d.byte() == 1 {
+			inst.Predict = d.pred(0)
+		}
+		program = append(program, inst)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.data) > 0 {
+		return errors.New("trailing data after program")
+	}
+	if err := program.check(); err != nil {
+		return err
+	}
+	*p = program
+	return nil
+}
+
+// programText is the text form of a program
+type programText struct {
+	Version int
+	Program []Inst
+}
+
+// MarshalText encodes the program as JSON, with the format version
+func (p Program) MarshalText() ([]byte, error) {
+	return json.Marshal(programText{programVersion, p})
+}
+
+// UnmarshalText decodes a program encoded by MarshalText
+func (p *Program) UnmarshalText(text []byte) error {
+	var t programText
+	if err := json.Unmarshal(text, &t); err != nil {
+		return err
+	}
+	if t.Version != programVersion {
+		return fmt.Errorf("unsupported program version %d", t.Version)
+	}
+	program := Program(t.Program)
+	if err := program.check(); err != nil {
+		return err
+	}
+	*p = program
+	return nil
+}
+
+// check validates a program read from outside, so that running it cannot
+// go out of the program
+func (p Program) check() error {
+	if len(p) == 0 {
+		return errors.New("empty program")
+	}
+	inRange := func(addr int) bool {
+		return addr >= 0 && addr < len(p)
+	}
+	for pc, inst := range p {
+		var err error
+		switch inst.Op {
+		case Predict:
+			err = inst.Predict.check()
+		case Ok:
+			if inst.A < 0 {
+				err = fmt.Errorf("pattern %d", inst.A)
+			}
+		case Jump:
+			if !inRange(inst.A) {
+				err = fmt.Errorf("jump to %d", inst.A)
+			}
+		case Split:
+			if !inRange(inst.A) || !inRange(inst.B) {
+				err = fmt.Errorf("split to %d and %d", inst.A, inst.B)
+			}
+		case Unanchored, Descend, NextSibling, FollowingSibling, PrevSibling, PrecedingSibling, Save:
+		default:
+			err = fmt.Errorf("unknown op %d", inst.Op)
+		}
+		if err == nil && inst.Op != Ok && inst.Op != Jump && inst.Op != Split && !inRange(pc+1) {
+			err = errors.New("falls off the end of the program")
+		}
+		if err != nil {
+			return fmt.Errorf("instruction %d: %v", pc, err)
+		}
+	}
+	return nil
+}
+
+type encoder struct {
+	bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.Write(e.scratch[:binary.PutUvarint(e.scratch[:], v)])
+}
+
+func (e *encoder) varint(v int64) {
+	e.Write(e.scratch[:binary.PutVarint(e.scratch[:], v)])
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) pred(p *Pred) {
+	e.uvarint(uint64(p.Op))
+	e.string(p.Name)
+	e.string(p.AttrOp)
+	e.string(p.Value)
+	e.varint(int64(p.A))
+	e.varint(int64(p.B))
+	e.uvarint(uint64(len(p.Subs)))
+	for _, sub := range p.Subs {
+		e.pred(sub)
+	}
+}
+
+// decoder reads what encoder writes. the first error is kept in err, and
+// later reads return zero values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+var errTruncated = errors.New("truncated program")
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) == 0 {
+		d.err = errTruncated
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.data)) {
+		d.err = errTruncated
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+// maxPredDepth bounds the nesting of decoded predicates
+const maxPredDepth = 1000
+
+func (d *decoder) pred(depth int) *Pred {
+	if depth > maxPredDepth {
+		d.err = errors.New("predicate nested too deep")
+	}
+	p := &Pred{
+		Op:     PredOp(d.uvarint()),
+		Name:   d.string(),
+		AttrOp: d.string(),
+		Value:  d.string(),
+		A:      int(d.varint()),
+		B:      int(d.varint()),
+	}
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.err = errTruncated
+	}
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		p.Subs = append(p.Subs, d.pred(depth+1))
+	}
+	return p
+}
+
+func (i Op) MarshalText() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+func (i *Op) UnmarshalText(text []byte) error {
+	for op := Predict; op <= Save; op++ {
+		if op.String() == string(text) {
+			*i = op
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown op %s", text)
+}
+
+func (i PredOp) MarshalText() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+func (i *PredOp) UnmarshalText(text []byte) error {
+	for op := PredAny; op <= PredText; op++ {
+		if op.String() == string(text) {
+			*i = op
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown predicate op %s", text)
+}
@@ -0,0 +1,101 @@
+package nm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var marshalCodes = []string{
+	`html > body > div`,
+	`... a.next[href^=http]:not([rel])`,
+	`table tr as row td:nth(2n+1) <~ td`,
+	`ul > li:not(.ad | #x):text(/a\/b/i)`,
+	`(a|b)* c? d+ + e ~ f`,
+	`dl dd:not(:textpart(x)) <+ dt:first`,
+}
+
+func TestMarshalProgram(t *testing.T) {
+	nodes, err := ParseString(`
+<html><body>
+	<div><a class="next" href="http://x">n</a><a class="next" href="http://y" rel="r">r</a></div>
+	<ul><li>a/b</li><li class="ad">A/B</li><li id="x">a/b</li><li>c</li></ul>
+	<table><tr><td>1</td><td>2</td><td>3</td></tr></table>
+	<dl><dt>k</dt><dd>v</dd></dl>
+</body></html>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := func(program Program) string {
+		var ret []string
+		for _, node := range nodes {
+			for _, n := range Match(node, program) {
+				ret = append(ret, strings.Join(n.TagPath(), ">")+"="+n.Text)
+			}
+		}
+		return strings.Join(ret, " ")
+	}
+	for _, code := range marshalCodes {
+		program := MustCompile(code)
+		want := texts(program)
+
+		bin, err := program.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fromBin Program
+		if err := fromBin.UnmarshalBinary(bin); err != nil {
+			t.Fatalf("%s: %v", code, err)
+		}
+		if got := texts(fromBin); got != want {
+			t.Fatalf("%s: binary got %s, want %s", code, got, want)
+		}
+		again, _ := fromBin.MarshalBinary()
+		if !bytes.Equal(again, bin) {
+			t.Fatalf("%s: binary not stable", code)
+		}
+
+		text, err := program.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fromText Program
+		if err := fromText.UnmarshalText(text); err != nil {
+			t.Fatalf("%s: %v", code, err)
+		}
+		if got := texts(fromText); got != want {
+			t.Fatalf("%s: text got %s, want %s", code, got, want)
+		}
+
+		// truncated or corrupted input is an error, never a panic
+		for i := 0; i < len(bin); i++ {
+			var p Program
+			if p.UnmarshalBinary(bin[:i]) == nil {
+				t.Fatalf("%s: truncated at %d", code, i)
+			}
+			corrupt := append([]byte(nil), bin...)
+			corrupt[i] ^= 0xff
+			p.UnmarshalBinary(corrupt)
+		}
+	}
+
+	var p Program
+	if err := p.UnmarshalText([]byte(`{"Version":2,"Program":[{"Op":"Ok"}]}`)); err == nil ||
+		err.Error() != "unsupported program version 2" {
+		t.Fatalf("version: %v", err)
+	}
+	if err := p.UnmarshalText([]byte(`{"Version":1,"Program":[{"Op":"Jump","A":5},{"Op":"Ok"}]}`)); err == nil {
+		t.Fatal("jump out of program")
+	}
+	if err := p.UnmarshalText([]byte(`{"Version":1,"Program":[{"Op":"Predict"},{"Op":"Ok"}]}`)); err == nil {
+		t.Fatal("missing predicate")
+	}
+	if err := p.UnmarshalText([]byte(`{"Version":1,"Program":[{"Op":"Predict","Predict":{"Op":"PredText","Name":"textpart","AttrOp":"*=","Value":"x"}},{"Op":"Ok"}]}`)); err == nil ||
+		err.Error() != `instruction 0: unknown text operator "*=" of textpart` {
+		t.Fatalf("text operator: %v", err)
+	}
+	if err := p.UnmarshalBinary([]byte("nm\x02")); err == nil || err.Error() != "unsupported program version 2" {
+		t.Fatalf("version: %v", err)
+	}
+}
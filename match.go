@@ -9,91 +9,513 @@ type Program []Inst
 
 type Inst struct {
 	Op      Op
-	Predict func(*Node) bool
-	A, B    int
+	Predict *Pred  `json:",omitempty"`
+	A       int    `json:",omitempty"`
+	B       int    `json:",omitempty"`
+	Name    string `json:",omitempty"` // capture name of Save
 }
 
 type Op int
 
 const (
 	Predict Op = iota
-	Ok
+	Ok         // A is the index of the pattern matched, in a PatternSet
 	Jump
 	Split
+	Unanchored // only at address 0, restarts the program at every node
+	Descend    // skips any number of levels
+	NextSibling
+	FollowingSibling
+	PrevSibling
+	PrecedingSibling
+	Save // binds the node matched last to the capture Name
 )
 
+// Match returns the nodes in the tree rooted at node whose path from node
+// matches program, in document order
 func Match(node *Node, program Program) []*Node {
-	var result []*Node
-	walk(node, []*Node{node}, program, &result)
-	return result
+	m := newMatcher(program, false)
+	m.walk(node, 0)
+	return m.result
 }
 
-func walk(node *Node, path []*Node, program Program, result *[]*Node) {
-	if program.Match(path) {
-		*result = append(*result, node)
+// PathMatch is a matched node with its path from the node matching started at
+type PathMatch struct {
+	Node *Node
+	Path []*Node // Path[0] is the start node, Path[len(Path)-1] is Node
+}
+
+// MatchWithPath is like Match but also returns the path of each matched node.
+// each path is a fresh copy and stays valid after further matching.
+func MatchWithPath(node *Node, program Program) []PathMatch {
+	m := newMatcher(program, false)
+	m.withPath = true
+	m.walk(node, 0)
+	ret := make([]PathMatch, len(m.result))
+	for i, n := range m.result {
+		ret[i] = PathMatch{
+			Node: n,
+			Path: m.paths[i],
+		}
+	}
+	return ret
+}
+
+// MatchCaptures is like Match but returns, for each matched node, the nodes
+// bound by the captures of the program, as in `table tr as row td as cell`.
+// a capture the match did not pass through, like one in another alternative,
+// is absent from the map.
+func MatchCaptures(node *Node, program Program) []map[string]*Node {
+	m := newMatcher(program, true)
+	m.walk(node, 0)
+	ret := make([]map[string]*Node, len(m.captures))
+	for i, caps := range m.captures {
+		ret[i] = make(map[string]*Node)
+		for slot, n := range caps {
+			if n != nil {
+				ret[i][m.names[slot]] = n
+			}
+		}
+	}
+	return ret
+}
+
+// matcher runs the program over a tree in one depth-first pass. the thread
+// sets are kept per depth, so moving to a sibling or back to an ancestor
+// needs no replay: the threads of the parent are still in place.
+type matcher struct {
+	program    Program
+	unanchored bool
+	states     []*_Threads // closed threads before the node at each depth
+	afters     []*_Threads // threads after the node at each depth
+	nexts      []*_Threads // threads waiting for the next sibling
+	followings []*_Threads // FollowingSibling threads, for all later siblings
+	result     []*Node
+
+	withPath bool
+	path     []*Node // nodes from the start node to the current one, reused
+	paths    [][]*Node
+
+	// backward sibling steps
+	backward bool         // program has backward steps
+	lists    [][]_Threads // per depth, the thread sets of sweep
+	ran      [][]int      // per depth, the threads of each sibling run
+	oks      [][]int      // per depth, the first Ok reached after each sibling
+
+	// captures, only kept for MatchCaptures
+	withCaps bool
+	ncap     int
+	slots    []int    // capture slot of each Save instruction
+	names    []string // capture name of each slot
+	captures [][]*Node
+
+	// pattern indexes, only kept for MatchSet
+	set      bool
+	patterns [][]int
+}
+
+func newMatcher(program Program, captures bool) *matcher {
+	m := &matcher{
+		program:    program,
+		unanchored: len(program) > 0 && program[0].Op == Unanchored,
+	}
+	for _, inst := range program {
+		if inst.Op == PrevSibling || inst.Op == PrecedingSibling {
+			m.backward = true
+			break
+		}
+	}
+	if captures {
+		m.withCaps = true
+		m.slots = make([]int, len(program))
+		for pc, inst := range program {
+			if inst.Op != Save {
+				continue
+			}
+			slot := 0
+			for slot < len(m.names) && m.names[slot] != inst.Name {
+				slot++
+			}
+			if slot == len(m.names) {
+				m.names = append(m.names, inst.Name)
+			}
+			m.slots[pc] = slot
+		}
+		m.ncap = len(m.names)
 	}
-	for _, c := range node.Children {
-		walk(c, append(path, c), program, result)
+	start := m.threadsAt(&m.states, 0)
+	m.fork(start, 0, nil, 0)
+	m.closure(start, 0, nil)
+	return m
+}
+
+// threadsAt returns the cleared thread set of depth d in list, allocating
+// the sets of the depth on first use
+func (m *matcher) threadsAt(list *[]*_Threads, d int) *_Threads {
+	for len(*list) <= d {
+		// the four sets of a depth share their storage
+		sets := newThreadSets(4, len(m.program), m.ncap)
+		m.states = append(m.states, &sets[0])
+		m.afters = append(m.afters, &sets[1])
+		m.nexts = append(m.nexts, &sets[2])
+		m.followings = append(m.followings, &sets[3])
 	}
+	t := (*list)[d]
+	t.clear()
+	return t
+}
+
+func (m *matcher) walk(node *Node, depth int) {
+	after := m.threadsAt(&m.afters, depth)
+	m.step(m.states[depth], 0, after, node)
+	m.enter(node, depth, after, 0)
+}
+
+// enter runs the threads of after from index from on, the threads new after
+// node: it reports node if they reach Ok, keeps their sibling steps and walks
+// the children with them
+func (m *matcher) enter(node *Node, depth int, after *_Threads, from int) {
+	if m.withPath {
+		m.path = append(m.path[:depth], node)
+	}
+	if pc := m.closure(after, from, node); pc >= 0 {
+		m.report(node, depth, after, pc)
+	}
+	if !m.backward { // sweep takes the sibling steps from after itself
+		for i := from; i < after.n; i++ {
+			pc := after.dense[i]
+			switch m.program[pc].Op {
+			case NextSibling:
+				m.fork(m.nexts[depth], pc+1, after, pc)
+			case FollowingSibling:
+				m.fork(m.followings[depth], pc, after, pc)
+			}
+		}
+	}
+	m.descend(node, depth, after, from)
+}
+
+// descend walks the children of node with the threads of after from index
+// from on
+func (m *matcher) descend(node *Node, depth int, after *_Threads, from int) {
+	if len(node.Children) == 0 {
+		return
+	}
+	if m.unanchored {
+		restart := after.n
+		m.fork(after, 0, nil, 0)
+		m.closure(after, restart, node)
+	}
+	if after.n == from { // no new threads
+		return
+	}
+	if m.backward {
+		m.sweep(node.Children, depth+1, after, from)
+		return
+	}
+	m.walkSiblings(node.Children, depth+1, after, from)
+}
+
+// walkSiblings walks nodes, children of the same parent at depth. each node
+// starts with the threads of base from index from on, and the threads
+// carried over from the nodes before it.
+func (m *matcher) walkSiblings(nodes []*Node, depth int, base *_Threads, from int) {
+	nexts := m.threadsAt(&m.nexts, depth)
+	followings := m.threadsAt(&m.followings, depth)
+	for _, node := range nodes {
+		in := m.threadsAt(&m.states, depth)
+		for i := from; i < base.n; i++ {
+			m.fork(in, base.dense[i], base, base.dense[i])
+		}
+		closed := in.n
+		for i := 0; i < nexts.n; i++ {
+			m.fork(in, nexts.dense[i], nexts, nexts.dense[i])
+		}
+		nexts.clear() // filled by node for the next sibling
+		for i := 0; i < followings.n; i++ {
+			m.fork(in, followings.dense[i]+1, followings, followings.dense[i])
+		}
+		if in.n == 0 {
+			if followings.n == 0 {
+				break
+			}
+			continue
+		}
+		m.closure(in, closed, node.Parent)
+		after := m.threadsAt(&m.afters, depth)
+		m.step(in, 0, after, node)
+		m.enter(node, depth, after, 0)
+	}
+}
+
+// sweep walks nodes like walkSiblings for programs with backward steps. it
+// keeps the threads before and after each node, and sweeps forward then
+// backward over the nodes, each carrying the sibling steps its way, until a
+// round runs no new thread. a node runs only the threads new to it, and the
+// threads of <~ are gathered from the last node back, as those of ~ are from
+// the first on, so a round takes time linear in the number of nodes. the
+// threads of a node only come from its parent and siblings, so the children
+// are walked once the rounds are over, each subtree once.
+func (m *matcher) sweep(nodes []*Node, depth int, base *_Threads, from int) {
+	for len(m.lists) <= depth {
+		m.lists = append(m.lists, nil)
+		m.ran = append(m.ran, nil)
+		m.oks = append(m.oks, nil)
+	}
+	if len(m.lists[depth]) < len(nodes)*2 {
+		m.lists[depth] = newThreadSets(len(nodes)*2, len(m.program), m.ncap)
+		m.ran[depth] = make([]int, len(nodes))
+		m.oks[depth] = make([]int, len(nodes))
+	}
+	ins, outs := m.lists[depth][:len(nodes)], m.lists[depth][len(nodes):len(nodes)*2]
+	ran, oks := m.ran[depth][:len(nodes)], m.oks[depth][:len(nodes)]
+	for j := range nodes {
+		ins[j].clear()
+		outs[j].clear()
+		ran[j] = 0
+		oks[j] = -1
+		for i := from; i < base.n; i++ {
+			m.fork(&ins[j], base.dense[i], base, base.dense[i])
+		}
+	}
+	carried := m.threadsAt(&m.followings, depth)
+	for {
+		progress := false
+		carried.clear()
+		for j, node := range nodes {
+			if j > 0 {
+				m.carry(&ins[j], &outs[j-1], NextSibling, nil)
+			}
+			m.carry(&ins[j], carried, FollowingSibling, nil)
+			progress = m.run(node, &ins[j], &outs[j], &ran[j], &oks[j]) || progress
+			m.carry(carried, &outs[j], FollowingSibling, carried)
+		}
+		carried.clear()
+		for j := len(nodes) - 1; j >= 0; j-- {
+			if j < len(nodes)-1 {
+				m.carry(&ins[j], &outs[j+1], PrevSibling, nil)
+			}
+			m.carry(&ins[j], carried, PrecedingSibling, nil)
+			progress = m.run(nodes[j], &ins[j], &outs[j], &ran[j], &oks[j]) || progress
+			m.carry(carried, &outs[j], PrecedingSibling, carried)
+		}
+		if !progress {
+			break
+		}
+	}
+	for j, node := range nodes {
+		if m.withPath {
+			m.path = append(m.path[:depth], node)
+		}
+		if oks[j] >= 0 {
+			m.report(node, depth, &outs[j], oks[j])
+		}
+		m.descend(node, depth, &outs[j], 0)
+	}
+}
+
+// carry forks the threads of src at a sibling step op into dst, past the
+// step, or at the step itself if dst gathers them for later nodes
+func (m *matcher) carry(dst, src *_Threads, op Op, gather *_Threads) {
+	for i := 0; i < src.n; i++ {
+		pc := src.dense[i]
+		if m.program[pc].Op != op {
+			continue
+		}
+		if dst == gather {
+			if !m.fork(dst, pc, src, pc) && op == PrecedingSibling && m.ncap > 0 {
+				// the nearest sibling binds the captures, as the later
+				// siblings are gathered first
+				copy(dst.captures(pc), src.captures(pc))
+			}
+		} else {
+			m.fork(dst, pc+1, src, pc)
+		}
+	}
+}
+
+// run runs on node the threads of in not run yet, the first *ran being run,
+// adding the closed threads after node to out and setting *ok to the first
+// Ok they reach. it reports whether there was any thread to run.
+func (m *matcher) run(node *Node, in, out *_Threads, ran, ok *int) bool {
+	if *ran == in.n {
+		return false
+	}
+	m.closure(in, *ran, node.Parent)
+	from := out.n
+	m.step(in, *ran, out, node)
+	*ran = in.n
+	if pc := m.closure(out, from, node); pc >= 0 && *ok < 0 {
+		*ok = pc
+	}
+	return true
+}
+
+// report adds node to the results, after reaches Ok first at pc
+func (m *matcher) report(node *Node, depth int, after *_Threads, pc int) {
+	var patterns []int
+	if m.set {
+		for i := 0; i < after.n; i++ {
+			if inst := m.program[after.dense[i]]; inst.Op == Ok {
+				patterns = addPattern(patterns, inst.A)
+			}
+		}
+	}
+	m.result = append(m.result, node)
+	if m.set {
+		m.patterns = append(m.patterns, patterns)
+	}
+	if m.withPath {
+		path := make([]*Node, depth+1)
+		copy(path, m.path)
+		m.paths = append(m.paths, path)
+	}
+	if m.withCaps { // one entry per result, empty without captures
+		caps := make([]*Node, m.ncap)
+		copy(caps, after.captures(pc))
+		m.captures = append(m.captures, caps)
+	}
+}
+
+// step runs the predicates of the threads of in from index from on, on
+// node, and adds the surviving threads to out
+func (m *matcher) step(in *_Threads, from int, out *_Threads, node *Node) {
+	for i := from; i < in.n; i++ {
+		pc := in.dense[i]
+		switch inst := m.program[pc]; inst.Op {
+		case Predict:
+			if inst.Predict.Match(node) {
+				m.fork(out, pc+1, in, pc)
+			}
+		case Descend: // skips any node
+			m.fork(out, pc, in, pc)
+		}
+	}
+}
+
+// closure follows the epsilon transitions of threads from index from on,
+// and returns the first thread reaching Ok, or -1 if none does. node is the
+// node matched last, bound by Save. sibling threads are left for the caller
+// to carry over.
+func (m *matcher) closure(t *_Threads, from int, node *Node) (ok int) {
+	ok = -1
+	for i := from; i < t.n; i++ {
+		pc := t.dense[i]
+		inst := m.program[pc]
+		switch inst.Op {
+		case Ok:
+			if ok < 0 {
+				ok = pc
+			}
+		case Jump:
+			m.fork(t, inst.A, t, pc)
+		case Split:
+			m.fork(t, inst.A, t, pc)
+			m.fork(t, inst.B, t, pc)
+		case Unanchored, Descend:
+			m.fork(t, pc+1, t, pc)
+		case Save:
+			if m.fork(t, pc+1, t, pc) && m.ncap > 0 {
+				t.captures(pc + 1)[m.slots[pc]] = node
+			}
+		}
+	}
+	return
+}
+
+// fork adds thread pc to dst with the captures of thread srcPC in src, or
+// with none if src is nil. it reports whether pc was not in dst yet; an
+// existing thread keeps its captures.
+func (m *matcher) fork(dst *_Threads, pc int, src *_Threads, srcPC int) bool {
+	if !dst.add(pc) {
+		return false
+	}
+	if m.ncap > 0 {
+		caps := dst.captures(pc)
+		if src == nil {
+			for i := range caps {
+				caps[i] = nil
+			}
+		} else {
+			copy(caps, src.captures(srcPC))
+		}
+	}
+	return true
 }
 
 type _Threads struct {
 	sparse, dense []int
 	n             int
+	ncap          int
+	caps          []*Node // captures of thread pc at caps[pc*ncap:]
+}
+
+func newThreads(size, ncap int) *_Threads {
+	return &newThreadSets(1, size, ncap)[0]
+}
+
+// newThreadSets returns n thread sets allocated together
+func newThreadSets(n, size, ncap int) []_Threads {
+	sets := make([]_Threads, n)
+	buf := make([]int, n*size*2)
+	var caps []*Node
+	if ncap > 0 {
+		caps = make([]*Node, n*size*ncap)
+	}
+	for i := range sets {
+		sets[i] = _Threads{
+			sparse: buf[:size:size],
+			dense:  buf[size : size*2 : size*2],
+			ncap:   ncap,
+			caps:   caps[: size*ncap : size*ncap],
+		}
+		buf = buf[size*2:]
+		caps = caps[size*ncap:]
+	}
+	return sets
 }
 
 func (t *_Threads) clear() {
 	t.n = 0
 }
 
-func (t *_Threads) add(i int) {
+func (t *_Threads) add(i int) bool {
 	if t.sparse[i] < t.n && t.dense[t.sparse[i]] == i {
-		return
+		return false
 	}
 	t.dense[t.n] = i
 	t.sparse[i] = t.n
 	t.n++
+	return true
 }
 
+func (t *_Threads) captures(pc int) []*Node {
+	return t.caps[pc*t.ncap : (pc+1)*t.ncap]
+}
+
+// Match reports whether the whole path matches the program: some thread
+// reaches Ok after the last node. a pattern matching only a prefix of the
+// path does not match it, even if other threads go on to the last node.
+// sibling steps never match, since a path holds no siblings.
 func (p Program) Match(path []*Node) bool {
-	activeThreads := &_Threads{make([]int, len(p)), make([]int, len(p)), 0}
-	nextThreads := &_Threads{make([]int, len(p)), make([]int, len(p)), 0}
-	activeThreads.add(0)
-	maxMatched := -1
+	m := newMatcher(p, false)
+	in := m.states[0]
+	return m.matchPath(in, m.closure(in, 0, nil) >= 0, path)
+}
+
+// matchPath runs the closed threads in over path and reports whether the
+// last node matches, or ok for an empty path
+func (m *matcher) matchPath(in *_Threads, ok bool, path []*Node) bool {
 	for n, node := range path {
-		for i := 0; i < activeThreads.n; i++ {
-			pc := activeThreads.dense[i]
-			inst := p[pc]
-			switch inst.Op {
-			case Predict:
-				if inst.Predict(node) {
-					nextThreads.add(pc + 1)
-					maxMatched = n
-				}
-			case Ok:
-				return maxMatched == len(path)-1 // match exactly
-			case Jump:
-				activeThreads.add(inst.A)
-			case Split:
-				activeThreads.add(inst.A)
-				activeThreads.add(inst.B)
-			}
-		}
-		activeThreads, nextThreads = nextThreads, activeThreads
-		nextThreads.clear()
-	}
-	for i := 0; i < activeThreads.n; i++ {
-		pc := activeThreads.dense[i]
-		inst := p[pc]
-		switch inst.Op {
-		case Ok:
-			return true
-		case Jump:
-			activeThreads.add(inst.A)
-		case Split:
-			activeThreads.add(inst.A)
-			activeThreads.add(inst.B)
+		out := m.threadsAt(&m.afters, n)
+		m.step(in, 0, out, node)
+		ok = m.closure(out, 0, node) >= 0
+		if m.unanchored {
+			from := out.n
+			m.fork(out, 0, nil, 0)
+			m.closure(out, from, node)
 		}
+		in = out
 	}
-	return false
+	return ok
 }
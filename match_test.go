@@ -3,6 +3,7 @@ package nm
 import (
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"testing"
 )
@@ -36,7 +37,7 @@ func TestSequence(t *testing.T) {
 			{Ok, nil, 0, 0},
 		})
 	*/
-	program := Compile(`html body div`)
+	program := MustCompile(`html > body > div`)
 	for _, node := range testNodes {
 		res := Match(node, program)
 		for _, n := range res {
@@ -64,7 +65,7 @@ func TestOr(t *testing.T) {
 			{Ok, nil, 0, 0},
 		})
 	*/
-	program := Compile(`html (head|body)`)
+	program := MustCompile(`html > (head|body)`)
 	for _, node := range testNodes {
 		res := Match(node, program)
 		if len(res) != 2 {
@@ -86,7 +87,7 @@ func TestZeroOrOne(t *testing.T) {
 			{Ok, nil, 0, 0},
 		})
 	*/
-	program := Compile(`html head?`)
+	program := MustCompile(`html > head?`)
 	for _, node := range testNodes {
 		res := Match(node, program)
 		if len(res) != 2 {
@@ -109,7 +110,7 @@ func TestZeroOrMany(t *testing.T) {
 			{Ok, nil, 0, 0},
 		})
 	*/
-	program := Compile(`html []*`)
+	program := MustCompile(`html > []*`)
 	for _, node := range testNodes {
 		res := Match(node, program)
 		if len(res) != 3 {
@@ -134,7 +135,7 @@ func TestOneOrMany(t *testing.T) {
 			{Ok, nil, 0, 0},
 		})
 	*/
-	program := Compile(`html body div+`)
+	program := MustCompile(`html > body > div+`)
 	for _, node := range testNodes {
 		res := Match(node, program)
 		for _, r := range res {
@@ -150,3 +151,734 @@ func TestOneOrMany(t *testing.T) {
 		}
 	}
 }
+
+func TestAttrExpr(t *testing.T) {
+	nodes, err := ParseString(`
+<div>
+	<a href="/foo" rel="nofollow">1</a>
+	<a href="/foo" rel="next">2</a>
+	<a href="/bar" class="x">3</a>
+	<a title="foo bar">4</a>
+</div>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		code  string
+		texts string
+	}{
+		{`div a[href=/foo]`, "1 2"},
+		{`div a[href=/foo && rel!=nofollow]`, "2"},
+		{`div a[href=/bar || rel=nofollow]`, "1 3"},
+		{`div a[ (href=/bar||rel=next) && class!=y ]`, "2 3"},
+		{`div a[title~=bar]`, "4"},
+		{`div a[title~=ba]`, ""},
+		{`div a[rel!=nofollow]`, "2 3 4"},
+		{`div a.x[href=/bar]`, "3"},
+		{`div a[]`, "1 2 3 4"},
+	}
+	for _, c := range cases {
+		var texts []string
+		for _, node := range nodes {
+			for _, n := range Match(node, MustCompile(c.code)) {
+				texts = append(texts, n.Text)
+			}
+		}
+		if strings.Join(texts, " ") != c.texts {
+			t.Fatalf("%s: got %v", c.code, texts)
+		}
+	}
+}
+
+func TestQuotedValue(t *testing.T) {
+	nodes, err := ParseString(`
+<div>
+	<a title="foo bar">1</a>
+	<a title="a]b&&c|d">2</a>
+	<a title='it&#39;s'>3</a>
+	<a title="back\slash">4</a>
+</div>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		code  string
+		texts string
+	}{
+		{`div a[title="foo bar"]`, "1"},
+		{`div a[title='foo bar']`, "1"},
+		{"div a[title=`foo bar`]", "1"},
+		{`div a[title="a]b&&c|d"]`, "2"},
+		{`div a[title='a]b&&c|d' || title="foo bar"]`, "1 2"},
+		{`div a[title='it\'s']`, "3"},
+		{`div a[title="back\\slash"]`, "4"},
+		{`div a[title!="foo bar" && title!='a]b&&c|d']`, "3 4"},
+	}
+	for _, c := range cases {
+		var texts []string
+		for _, node := range nodes {
+			for _, n := range Match(node, MustCompile(c.code)) {
+				texts = append(texts, n.Text)
+			}
+		}
+		if strings.Join(texts, " ") != c.texts {
+			t.Fatalf("%s: got %v", c.code, texts)
+		}
+	}
+}
+
+func TestAttrOperators(t *testing.T) {
+	nodes, err := ParseString(`
+<div>
+	<a href="http://foo.com/a.png" lang="en-US">1</a>
+	<a href="https://bar.com/b.PNG" lang="en">2</a>
+	<a href="/baz.html" lang="english" data-x="">3</a>
+	<a>4</a>
+</div>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		code    string
+		texts   string
+		wantErr string // "syntax", or the kind of the CompileError
+	}{
+		{`div a[href^=http]`, "1 2", ""},
+		{`div a[href^=""]`, "", ""},
+		{`div a[href$=.png]`, "1", ""},
+		{`div a[href*=".com/"]`, "1 2", ""},
+		{`div a[lang|=en]`, "1 2", ""},
+		{`div a[lang~=en]`, "2", ""},
+		{`div a[lang!=en]`, "1 3 4", ""},
+		{`div a[href=~/\.png$/]`, "1", ""},
+		{`div a[href=~/\.png$/i]`, "1 2", ""},
+		{`div a[href=~/^\/baz/]`, "3", ""},
+		{`div a[href]`, "1 2 3", ""},
+		{`div a[data-x]`, "3", ""},
+		{`div a[data-x || lang=en]`, "2 3", ""},
+		{`div a[(href$=.png || href=~/png$/i) && lang^=en-]`, "1", ""},
+		{`div a[href && !=x]`, "", "syntax"},
+		{`div a[href=~/png/q]`, "", "unsupported operator"},
+		{`div a[href=~/(png/]`, "", "invalid regexp"},
+	}
+	for _, c := range cases {
+		program, err := Compile(c.code)
+		if c.wantErr != "" {
+			var kind string
+			switch err := err.(type) {
+			case *SyntaxError:
+				kind = "syntax"
+			case *CompileError:
+				kind = err.Kind.String()
+			}
+			if kind != c.wantErr {
+				t.Fatalf("%s: got error %v, want %s", c.code, err, c.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.code, err)
+		}
+		var texts []string
+		for _, node := range nodes {
+			for _, n := range Match(node, program) {
+				texts = append(texts, n.Text)
+			}
+		}
+		if strings.Join(texts, " ") != c.texts {
+			t.Fatalf("%s: got %v", c.code, texts)
+		}
+	}
+
+	// a predicate built by hand compiles its regexp once, and panics if it
+	// is invalid
+	p := &Pred{Op: PredAttr, Name: "href", AttrOp: "=~", Value: `^/fo+$`}
+	if !p.Match(&Node{Attr: map[string]string{"href": "/foo"}}) || p.Match(&Node{Attr: map[string]string{"href": "/bar"}}) {
+		t.Fatal("hand-built regexp")
+	}
+	if p.re == nil {
+		t.Fatal("regexp not kept")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("invalid hand-built regexp")
+			}
+		}()
+		(&Pred{Op: PredAttr, Name: "href", AttrOp: "=~", Value: `(`}).Match(&Node{Attr: map[string]string{"href": "("}})
+	}()
+}
+
+func TestTextPredicate(t *testing.T) {
+	nodes, err := ParseString(`
+<table>
+	<tr><td>Price</td><td text="t">42</td><td><span></span></td></tr>
+	<tr><td>Unit Price: <b>x</b> USD</td><td>n/a</td><td><span>-</span></td></tr>
+</table>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		code  string
+		texts string
+	}{
+		{`table tr td:contains("Price")`, "Price Unit Price:USD"},
+		{`table tr td:text("Price")`, "Price"},
+		{`table tr td:text(/^\d+$/)`, "42"},
+		{`table tr td:textpart(USD)`, "Unit Price:USD"},
+		{`table tr td:textpart(/^Unit/):textpart(/USD$/)`, "Unit Price:USD"},
+		{`table tr td:not(:textpart(USD)):not(:text(""))`, "Price 42 n/a"},
+		{`table tr td:text('')`, " "},
+		{`table tr td span:text("")`, ""},
+		{`table tr td[text]`, "42"},
+		{`table tr td[text=t]`, "42"},
+		{`table tr td[text=Price]`, ""},
+		{`table tr td[textpart || empty]`, ""},
+	}
+	for _, c := range cases {
+		var texts []string
+		for _, node := range nodes {
+			for _, n := range Match(node, MustCompile(c.code)) {
+				texts = append(texts, n.Text)
+			}
+		}
+		if strings.Join(texts, " ") != c.texts {
+			t.Fatalf("%s: got %q", c.code, texts)
+		}
+	}
+
+	_, err = Compile(`td:contains(/x/)`)
+	if e, ok := err.(*CompileError); !ok || e.Kind != UnsupportedOperator {
+		t.Fatalf(":contains regexp: %v", err)
+	}
+}
+
+func TestPseudo(t *testing.T) {
+	nodes, err := ParseString(`
+<ul>
+	<li>1</li>
+	<li>2</li>
+	<p>p1</p>
+	<li>3</li>
+	<p>p2</p>
+	<li>4</li>
+	<li>5<b>b</b></li>
+</ul>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		code  string
+		texts string
+	}{
+		{`ul > li:first`, "1"},
+		{`ul > li:last`, "5"},
+		{`ul > p:last`, ""},
+		{`ul > :last`, "5"},
+		{`ul > li:nth(2)`, "2"},
+		{`ul > li:nth(2n+1)`, "1 5"},
+		{`ul > li:nth(odd)`, "1 5"},
+		{`ul > :nth(even)`, "2 3 4"},
+		{`ul > :nth( -n + 3 )`, "1 2 p1"},
+		{`ul > :nth(n+6)`, "4 5"},
+		{`ul > :nth-last(1)`, "5"},
+		{`ul > :nth-last(2n)`, "2 3 4"},
+		{`ul > li:nth-of-type(3)`, "3"},
+		{`ul > p:nth-of-type(2)`, "p2"},
+		{`ul > li:nth-last-of-type(1)`, "5"},
+		{`ul > li > b:only-child`, "b"},
+		{`ul > li:empty`, ""},
+		{`ul > li > b:empty`, ""},
+		{`ul > li:first.x`, ""},
+	}
+	for _, c := range cases {
+		var texts []string
+		for _, node := range nodes {
+			for _, n := range Match(node, MustCompile(c.code)) {
+				texts = append(texts, n.Text)
+			}
+		}
+		if strings.Join(texts, " ") != c.texts {
+			t.Fatalf("%s: got %v", c.code, texts)
+		}
+	}
+}
+
+func TestNegation(t *testing.T) {
+	nodes, err := ParseString(`
+<div>
+	<div class="ad">1</div>
+	<div class="post">2</div>
+	<a href="/a" rel="nofollow">3</a>
+	<abbr href="/b">4</abbr>
+	<a href="/c">5</a>
+	<p>6</p>
+</div>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		code  string
+		texts string
+	}{
+		{`div div:not(.ad)`, "2"},
+		{`div div!.ad`, "2"},
+		{`div !div`, "3 4 5 6"},
+		{`div (a|abbr)`, "3 4 5"},
+		{`div ( a | abbr )`, "3 4 5"},
+		{`div a|div abbr`, "3 4 5"},
+		{`div (a|abbr):not([rel=nofollow])`, "4 5"},
+		{`div (a|abbr)![rel=nofollow]`, "4 5"},
+		{`div (a|abbr)[href^=/][rel!=nofollow]:last`, ""},
+		{`div (a|abbr)[href^=/][rel!=nofollow]:nth(5)`, "5"},
+		{`div :not(div|p)`, "3 4 5"},
+		{`div :not(div.ad | a[rel])`, "2 4 5 6"},
+		{`div !(a|abbr|div)`, "6"},
+		{`div (div|p):not(.ad|:nth(2))`, "6"},
+		{`div [href]:not(abbr)`, "3 5"},
+	}
+	for _, c := range cases {
+		var texts []string
+		for _, node := range nodes {
+			for _, n := range Match(node, MustCompile(c.code)) {
+				texts = append(texts, n.Text)
+			}
+		}
+		if strings.Join(texts, " ") != c.texts {
+			t.Fatalf("%s: got %v", c.code, texts)
+		}
+	}
+
+	// alternatives of single steps compile to one predicate
+	if n := len(MustCompile(`div > (a|abbr|p)`)); n != 3 {
+		t.Fatalf("expecting 3 instructions, got %d", n)
+	}
+}
+
+func TestUnanchored(t *testing.T) {
+	nodes, err := ParseString(`
+<html><body>
+	<ul>
+		<li><a>1</a></li>
+		<li><p><a>2</a></p></li>
+	</ul>
+	<div><ul><li><a>3</a></li></ul></div>
+	<a>4</a>
+</body></html>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		code  string
+		texts string
+	}{
+		{`ul li a`, ""},
+		{`... ul > li > a`, "1 3"},
+		{`//ul>li>a`, "1 3"},
+		{`... ul li a`, "1 2 3"},
+		{`// a`, "1 2 3 4"},
+		{`...a`, "1 2 3 4"},
+		{`... body > a`, "4"},
+		{`... body a`, "1 2 3 4"},
+		{`... ul > li > []* > a`, "1 2 3"},
+		{`... div? > ul > li > a`, "1 3"},
+		{`... (div|body) > ul > li > a`, "1 3"},
+		{`... html > body > ul > li > a`, "1"},
+		{`html ul a`, "1 2 3"},
+		{`html > ul a`, ""},
+	}
+	for _, c := range cases {
+		var texts []string
+		for _, node := range nodes {
+			for _, n := range Match(node, MustCompile(c.code)) {
+				texts = append(texts, n.Text)
+			}
+		}
+		if strings.Join(texts, " ") != c.texts {
+			t.Fatalf("%s: got %v", c.code, texts)
+		}
+	}
+	if p := MustCompile(`... ul > li > a`); p[0].Op != Unanchored || len(p) != 5 {
+		t.Fatalf("unanchored program %v", p)
+	}
+}
+
+func genTree(depth, width int) *Node {
+	root := &Node{Tag: "ROOT"}
+	var gen func(parent *Node, level int)
+	gen = func(parent *Node, level int) {
+		if level == depth {
+			return
+		}
+		for i := 0; i < width; i++ {
+			node := &Node{
+				Parent: parent,
+				Tag:    []string{"div", "p", "a"}[(level+i)%3],
+			}
+			if i%2 == 0 {
+				node.Class = []string{"even"}
+			}
+			parent.Children = append(parent.Children, node)
+			gen(node, level+1)
+		}
+	}
+	gen(root, 0)
+	return root
+}
+
+func TestMatchPaths(t *testing.T) {
+	root := genTree(6, 4)
+	codes := []string{
+		`ROOT div`,
+		`ROOT []* a`,
+		`ROOT (div|p)+ a.even`,
+		`ROOT div? p []* a`,
+		`... p a`,
+		`... .even .even .even`,
+		`// div []*`,
+	}
+	for _, code := range codes {
+		program := MustCompile(code)
+		var expected []*Node
+		var walk func(node *Node, path []*Node)
+		walk = func(node *Node, path []*Node) {
+			path = append(path[:len(path):len(path)], node)
+			if program.Match(path) {
+				expected = append(expected, node)
+			}
+			for _, c := range node.Children {
+				walk(c, path)
+			}
+		}
+		walk(root, nil)
+		res := Match(root, program)
+		if len(res) != len(expected) {
+			t.Fatalf("%s: got %d expected %d", code, len(res), len(expected))
+		}
+		for i, n := range res {
+			if n != expected[i] {
+				t.Fatalf("%s: result %d not match", code, i)
+			}
+		}
+	}
+}
+
+func TestMatchWholePath(t *testing.T) {
+	// the first versions reported a match when a prefix of the path matched
+	// and some thread had tested the last node, so div (p | p span a)
+	// matched div > p > span. a match now needs a thread reaching Ok after
+	// the last node.
+	cases := []struct {
+		code  string
+		path  string
+		match bool
+	}{
+		{`div (p | p span a)`, "div p", true},
+		{`div (p | p span a)`, "div p span", false},
+		{`div (p | p span a)`, "div p span a", true},
+		{`div (p | p span a)`, "div p span a b", false},
+		{`div p`, "div p span", false},
+		{`div (p | p span)`, "div p", true},
+		{`div (p | p span)`, "div p span", true},
+		{`div []*`, "div x y", true},
+		{`... p a`, "div p a", true},
+		{`... p a`, "div p a x", false},
+	}
+	for _, c := range cases {
+		var path []*Node
+		for _, tag := range strings.Fields(c.path) {
+			path = append(path, &Node{Tag: tag})
+		}
+		if MustCompile(c.code).Match(path) != c.match {
+			t.Fatalf("%s: path %s: expected %v", c.code, c.path, c.match)
+		}
+	}
+}
+
+func TestMatchAllocs(t *testing.T) {
+	root := genTree(6, 4)
+	program := MustCompile(`... div p span`)
+	allocs := testing.AllocsPerRun(10, func() {
+		if len(Match(root, program)) != 0 {
+			t.Fatal("match")
+		}
+	})
+	if allocs > 50 { // thread sets per depth only, the tree has 5460 nodes
+		t.Fatalf("%v allocations", allocs)
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	root := genTree(8, 4)
+	program := MustCompile(`... div (p|a)+ a.even`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Match(root, program)
+	}
+}
+
+func TestMatchWithPath(t *testing.T) {
+	// wide and deep enough that a path slice shared between siblings
+	// would have spare capacity to be overwritten
+	root := genTree(7, 5)
+	program := MustCompile(`ROOT []* (a|p).even`)
+	res := MatchWithPath(root, program)
+	if len(res) == 0 {
+		t.Fatal("match")
+	}
+	MatchWithPath(root, MustCompile(`ROOT []*`)) // must not disturb returned paths
+	nodes := Match(root, program)
+	if len(nodes) != len(res) {
+		t.Fatal("match")
+	}
+	for i, r := range res {
+		if r.Node != nodes[i] || r.Path[len(r.Path)-1] != r.Node || r.Path[0] != root {
+			t.Fatal("path ends")
+		}
+		for j := 1; j < len(r.Path); j++ {
+			if r.Path[j].Parent != r.Path[j-1] {
+				t.Fatalf("path %d broken at %d", i, j)
+			}
+		}
+		if !program.Match(r.Path) {
+			t.Fatalf("path %d not match", i)
+		}
+	}
+	for i := 1; i < len(res); i++ {
+		if &res[i].Path[0] == &res[i-1].Path[0] {
+			t.Fatal("paths share backing array")
+		}
+	}
+}
+
+func TestCombinators(t *testing.T) {
+	nodes, err := ParseString(`
+<div>
+	<dl>
+		<dt>Name</dt><dd>foo</dd>
+		<dt>Price</dt><dd>42</dd><dd>43</dd>
+		<dt>Note</dt><dd>baz<span>bar</span></dd>
+	</dl>
+	<p>x</p><span>y</span>
+</div>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		code  string
+		texts string
+	}{
+		{`div span`, "bar y"},
+		{`div > span`, "y"},
+		{`div>dl>dd span`, "bar"},
+		{`div dt + dd`, "foo 42 baz"},
+		{`div dt+dd`, "foo 42 baz"},
+		{`div dd~dd`, "42 43 baz"},
+		{`div>p`, "x"},
+		{`div>dl+ dt`, "Name Price Note"},
+		{`div dt:text(Price) + dd`, "42"},
+		{`div dt:text(Price) ~ dd`, "42 43 baz"},
+		{`div dt:text(Price)~dd:nth-of-type(3)`, "43"},
+		{`div dt:text(Note) + dd span`, "bar"},
+		{`div dt:text(Note) + dd > span`, "bar"},
+		{`div dt:text(Note) + dd + dd`, ""},
+		{`div dd + dd`, "43"},
+		{`div dt ~ dt + dd`, "42 baz"},
+		{`div dl ~ span`, "y"},
+		{`div dl + span`, ""},
+		{`div dl + p + span`, "y"},
+		{`div > (dl|p) ~ span`, "y"},
+		{`... dt + dd`, "foo 42 baz"},
+		{`... (dt + dd | dd + dd)`, "foo 42 43 baz"},
+		{`div (dt:text(Name) + dd | dt:text(Note) + dd)`, "foo baz"},
+	}
+	for _, c := range cases {
+		var texts []string
+		for _, node := range nodes {
+			for _, n := range Match(node, MustCompile(c.code)) {
+				texts = append(texts, n.Text)
+			}
+		}
+		if strings.Join(texts, " ") != c.texts {
+			t.Fatalf("%s: got %v", c.code, texts)
+		}
+	}
+}
+
+func TestBackwardSiblings(t *testing.T) {
+	nodes, err := ParseString(`
+<dl>
+	<dt>Name</dt><dd>foo</dd>
+	<dt>Price</dt><dd>42</dd>
+	<dt>Note</dt><dd>baz<span>bar</span></dd>
+	<dt>Tag</dt><dd>x</dd><dd>y</dd>
+</dl>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		code  string
+		texts string
+	}{
+		{`dl dd:text(42) <+ dt`, "Price"},
+		{`dl dd <+ dt`, "Name Price Note Tag"},
+		{`dl dd:text(y) <+ dt`, ""},
+		{`dl dd:text(y) <+ dd`, "x"},
+		{`dl dd:text(42) <~ dt`, "Name Price"},
+		{`dl dd:text(42) <~ (dt|dd)`, "Name foo Price"},
+		{`dl dd span <+ []`, ""},
+		{`dl dd:text(baz) <+ dt + dd > span`, "bar"},
+		{`dl dd:text(baz) <~ dt:text(Name) ~ dt`, "Price Note Tag"},
+		{`dl dd:text(42) <+ dt <+ dd <+ dt`, "Name"},
+		{`... dd:text(y) <~ dt`, "Name Price Note Tag"},
+		{`dl (dd:text(foo) | dd:text(42) <+ dt | dt:text(Name))`, "Name foo Price"},
+		{`dl dd:text(x) <~ dt ~ dd <+ dt`, "Name Price Note Tag"},
+		{`dl dd:text(x) <~ dd > span`, "bar"},
+		{`dl dd:text(y) <+ dd <~ dt:text(Price) ~ dt <+ dd`, "42 baz"},
+	}
+	for _, c := range cases {
+		var texts []string
+		for _, node := range nodes {
+			for _, n := range Match(node, MustCompile(c.code)) {
+				texts = append(texts, n.Text)
+			}
+		}
+		if strings.Join(texts, " ") != c.texts {
+			t.Fatalf("%s: got %v", c.code, texts)
+		}
+	}
+
+	res := MatchWithPath(nodes[0], MustCompile(`dl dd <~ dt:text(Price)`))
+	if len(res) != 1 || len(res[0].Path) != 2 || res[0].Path[0] != nodes[0] || res[0].Path[1] != res[0].Node {
+		t.Fatal("path")
+	}
+
+	var got []string
+	for _, caps := range MatchCaptures(nodes[0], MustCompile(`dl dd:text(y) <~ dt as t + dd as d`)) {
+		got = append(got, caps["t"].Text+"="+caps["d"].Text)
+	}
+	if strings.Join(got, " ") != "Name=foo Price=42 Note=baz Tag=x" {
+		t.Fatalf("captures: got %v", got)
+	}
+
+	// every sibling runs the <~ threads once, gathered from the last one back
+	wide, err := ParseString("<ul>" + strings.Repeat("<li>x</li><li>y</li>", 500) + "</ul>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = MatchWithPath(wide[0], MustCompile(`ul li:last <~ li:text(y)`))
+	if len(res) != 499 {
+		t.Fatalf("got %d", len(res))
+	}
+	for i, r := range res {
+		if r.Node.Index() != i*2+1 || r.Path[1] != r.Node {
+			t.Fatalf("result %d is sibling %d", i, r.Node.Index())
+		}
+	}
+}
+
+func BenchmarkPrecedingSiblings(b *testing.B) {
+	nodes, err := ParseString("<ul>" + strings.Repeat("<li>x</li>", 2000) + "</ul>")
+	if err != nil {
+		b.Fatal(err)
+	}
+	program := MustCompile(`ul li <~ li`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Match(nodes[0], program)
+	}
+}
+
+// backward sibling steps cost about what forward ones do, each subtree being
+// walked once
+func BenchmarkBackwardSiblings(b *testing.B) {
+	for _, c := range []struct {
+		name          string
+		depth, width  int
+		forward, back string
+	}{
+		{"deep", 8, 4, `... [] ~ [] [] ~ [] [] ~ []`, `... [] <~ [] [] <~ [] [] <~ []`},
+		{"wide", 3, 50, `... ([] ~ [])+ > ([] ~ [])+`, `... ([] <~ [])+ > ([] ~ [])+`},
+	} {
+		root := genTree(c.depth, c.width)
+		for _, code := range []string{c.forward, c.back} {
+			program := MustCompile(code)
+			name := c.name + "/forward"
+			if code == c.back {
+				name = c.name + "/backward"
+			}
+			b.Run(name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					Match(root, program)
+				}
+			})
+		}
+	}
+}
+
+func TestCaptures(t *testing.T) {
+	nodes, err := ParseString(`
+<table>
+	<tr id="r1"><td>apple</td><td>3</td></tr>
+	<tr id="r2"><td>pear</td><td>5</td></tr>
+</table>
+<dl><dt>Name</dt><dd>foo</dd></dl>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		code string
+		caps string
+	}{
+		{`table (tr as row) (td:nth(2) as price)`, "price=3 row=r1 | price=5 row=r2"},
+		{`table tr as row > td:first as name`, "name=apple row=r1 | name=pear row=r2"},
+		{`table > tr:first > (td as cell)`, "cell=apple | cell=3"},
+		{`(table > tr > td:first as a | dl > dt as a)`, "a=apple | a=pear | a=Name"},
+		{`table > tr > (td:first as first | td:last as last)`, "first=apple | last=3 | first=pear | last=5"},
+		{`dl > dt as term + dd`, "term=Name"},
+		{`dl > dd <+ dt as term`, "term=Name"},
+		{`... td:text(5) as n`, "n=5"},
+		{`table > tr > td:last`, " | "}, // a match without captures
+	}
+	for _, c := range cases {
+		var matches []string
+		for _, node := range nodes {
+			for _, caps := range MatchCaptures(node, MustCompile(c.code)) {
+				var parts []string
+				for name, n := range caps {
+					parts = append(parts, name+"="+n.Id+n.Text)
+				}
+				sort.Strings(parts)
+				matches = append(matches, strings.Join(parts, " "))
+			}
+		}
+		if strings.Join(matches, " | ") != c.caps {
+			t.Fatalf("%s: got %q", c.code, matches)
+		}
+	}
+
+	// captures do not change what matches, and there is a map per match
+	for code, want := range map[string]int{
+		`table tr as row td`:   4,
+		`table (tr as row) td`: 4,
+		`table tr td`:          4,
+		`... td <~ td`:         2,
+	} {
+		if n := len(Match(nodes[0], MustCompile(code))); n != want {
+			t.Fatalf("%s: %d matches", code, n)
+		}
+		if n := len(MatchCaptures(nodes[0], MustCompile(code))); n != want {
+			t.Fatalf("%s: %d captures", code, n)
+		}
+	}
+}
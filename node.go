@@ -1,9 +1,6 @@
 package nm
 
-import (
-	"bytes"
-	"fmt"
-)
+import "fmt"
 
 type Node struct {
 	Parent   *Node
@@ -14,11 +11,14 @@ type Node struct {
 	TextParts []string
 	Attr      map[string]string
 
+	textAt []int // number of children before each of TextParts
+
 	Id    string
 	Class []string
 
-	Raw    string
-	rawBuf *bytes.Buffer
+	Raw string // the html of the node, sliced from the one copy of the document
+
+	Pos Pos
 }
 
 func (n *Node) Compare(right *Node) error {
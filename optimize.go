@@ -0,0 +1,286 @@
+package nm
+
+// Optimize returns a program matching the same nodes as program, in fewer
+// steps. it simplifies predicates, threads jumps through jumps, collapses
+// splits whose branches are the same, and drops unreachable instructions
+// and jumps to the next instruction. Compile already optimizes.
+func Optimize(program Program) Program {
+	p := make(Program, len(program))
+	copy(p, program)
+	for pc := range p {
+		if p[pc].Op == Predict {
+			p[pc].Predict = p[pc].Predict.simplify()
+		}
+	}
+	p.thread()
+	if p.reduceSplits() {
+		p.thread()
+	}
+	return p.compact()
+}
+
+// thread points jumps and splits past the jumps they lead to, and collapses
+// splits whose branches are the same
+func (p Program) thread() {
+	for changed, rounds := true, 0; changed && rounds <= len(p); rounds++ {
+		changed = false
+		for pc := range p {
+			inst := p[pc]
+			switch inst.Op {
+			case Jump:
+				target := p.follow(inst.A)
+				switch p[target].Op {
+				case Ok, Split: // the jump does what the target does
+					inst = p[target]
+				default:
+					inst.A = target
+				}
+			case Split:
+				inst.A, inst.B = p.follow(inst.A), p.follow(inst.B)
+				if inst.A == inst.B || p.sameStep(inst.A, inst.B) {
+					inst = Inst{Jump, nil, inst.A, 0, ""}
+				}
+			}
+			if inst != p[pc] {
+				p[pc] = inst
+				changed = true
+			}
+		}
+	}
+}
+
+// follow returns where a thread at addr ends up after the jumps
+func (p Program) follow(addr int) int {
+	for n := 0; p[addr].Op == Jump && n < len(p); n++ {
+		addr = p[addr].A
+	}
+	return addr
+}
+
+// sameStep reports whether a and b test the same predicate and go on to
+// the same instruction
+func (p Program) sameStep(a, b int) bool {
+	return p[a].Op == Predict && p[b].Op == Predict &&
+		p[a].Predict.equal(p[b].Predict) &&
+		p.follow(a+1) == p.follow(b+1)
+}
+
+// compact drops the unreachable instructions and the jumps to the next
+// kept instruction, renumbering the rest
+func (p Program) compact() Program {
+	keep := make([]bool, len(p))
+	stack := []int{0}
+	for len(stack) > 0 {
+		pc := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if pc >= len(p) || keep[pc] {
+			continue
+		}
+		keep[pc] = true
+		switch inst := p[pc]; inst.Op {
+		case Ok:
+		case Jump:
+			stack = append(stack, inst.A)
+		case Split:
+			stack = append(stack, inst.A, inst.B)
+		default:
+			stack = append(stack, pc+1)
+		}
+	}
+	for pc := len(p) - 1; pc >= 0; pc-- {
+		if !keep[pc] || p[pc].Op != Jump || p[pc].A <= pc {
+			continue
+		}
+		noop := true
+		for i := pc + 1; i < p[pc].A; i++ {
+			noop = noop && !keep[i]
+		}
+		keep[pc] = !noop
+	}
+	addrs := make([]int, len(p)) // new address, or that of the next kept one
+	n := 0
+	for pc := range p {
+		addrs[pc] = n
+		if keep[pc] {
+			n++
+		}
+	}
+	ret := make(Program, 0, n)
+	for pc, inst := range p {
+		if !keep[pc] {
+			continue
+		}
+		switch inst.Op {
+		case Jump:
+			inst.A = addrs[inst.A]
+		case Split:
+			inst.A, inst.B = addrs[inst.A], addrs[inst.B]
+		}
+		ret = append(ret, inst)
+	}
+	return ret
+}
+
+// simplify returns p with nested conjunctions and disjunctions flattened,
+// repeated operands and double negations dropped. p is left unchanged.
+func (p *Pred) simplify() *Pred {
+	switch p.Op {
+	case PredNot:
+		sub := p.Subs[0].simplify()
+		if sub.Op == PredNot {
+			return sub.Subs[0]
+		}
+		return &Pred{Op: PredNot, Subs: []*Pred{sub}}
+	case PredAnd, PredOr:
+		var subs []*Pred
+		hasAny := false
+		var add func(q *Pred)
+		add = func(q *Pred) {
+			if q.Op == p.Op {
+				for _, sub := range q.Subs {
+					add(sub.simplify())
+				}
+				return
+			}
+			if q.Op == PredAny {
+				hasAny = true
+				return
+			}
+			for _, sub := range subs {
+				if sub.equal(q) {
+					return
+				}
+			}
+			subs = append(subs, q)
+		}
+		for _, sub := range p.Subs {
+			add(sub.simplify())
+		}
+		if hasAny && p.Op == PredOr || len(subs) == 0 {
+			return &Pred{Op: PredAny}
+		}
+		if len(subs) == 1 {
+			return subs[0]
+		}
+		return &Pred{Op: p.Op, Subs: subs}
+	}
+	return p
+}
+
+func (p *Pred) equal(q *Pred) bool {
+	if p.Op != q.Op || p.Name != q.Name || p.AttrOp != q.AttrOp || p.Value != q.Value ||
+		p.A != q.A || p.B != q.B || len(p.Subs) != len(q.Subs) {
+		return false
+	}
+	for i, sub := range p.Subs {
+		if !sub.equal(q.Subs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// maxReduce bounds the size of programs whose splits are reduced, each
+// round being quadratic in the size
+const maxReduce = 512
+
+// reduceSplits simplifies splits without changing what any address
+// reaches: a split becomes a jump when one branch alone reaches everything,
+// and a branch leading to another split may skip it. this untangles nested
+// loops like (a*)*. it reports whether any split changed.
+//
+// rewriting the split at pc only changes the edges out of pc, and a path
+// from any address either avoids pc or goes on from pc, so every address
+// reaches the same instructions as before if pc does
+func (p Program) reduceSplits() (changed bool) {
+	if len(p) > maxReduce {
+		return false
+	}
+	try := func(pc int, inst Inst, before []bool) bool {
+		old := p[pc]
+		p[pc] = inst
+		if sameClosure(before, p.closure(pc)) {
+			return true
+		}
+		p[pc] = old
+		return false
+	}
+	for round := 0; round < 4; round++ {
+		progress := false
+		for pc, split := range p {
+			if split.Op != Split {
+				continue
+			}
+			before := p.closure(pc)
+			if try(pc, Inst{Jump, nil, split.A, 0, ""}, before) || try(pc, Inst{Jump, nil, split.B, 0, ""}, before) {
+				progress = true
+				continue
+			}
+			for _, a := range p.branches(split.A, pc) {
+				if try(pc, Inst{Split, nil, a, split.B, ""}, before) {
+					progress = true
+					break
+				}
+			}
+			split = p[pc]
+			for _, b := range p.branches(split.B, pc) {
+				if try(pc, Inst{Split, nil, split.A, b, ""}, before) {
+					progress = true
+					break
+				}
+			}
+		}
+		if !progress {
+			break
+		}
+		changed = true
+	}
+	return
+}
+
+// branches returns the targets of the split at addr other than self
+func (p Program) branches(addr, self int) (ret []int) {
+	if p[addr].Op != Split {
+		return nil
+	}
+	for _, target := range []int{p[addr].A, p[addr].B} {
+		if target != self && target != addr {
+			ret = append(ret, target)
+		}
+	}
+	return
+}
+
+// closure returns the set of instructions other than jumps and splits that
+// a thread at start reaches without consuming a node
+func (p Program) closure(start int) []bool {
+	set := make([]bool, len(p))
+	seen := make([]bool, len(p))
+	stack := []int{start}
+	for len(stack) > 0 {
+		pc := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[pc] {
+			continue
+		}
+		seen[pc] = true
+		switch inst := p[pc]; inst.Op {
+		case Jump:
+			stack = append(stack, inst.A)
+		case Split:
+			stack = append(stack, inst.A, inst.B)
+		default:
+			set[pc] = true
+		}
+	}
+	return set
+}
+
+func sameClosure(a, b []bool) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
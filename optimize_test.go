@@ -0,0 +1,119 @@
+package nm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var optimizeCodes = []string{
+	`html > body > div`,
+	`html body div a`,
+	`... div`,
+	`// a[href]`,
+	`html > (head | body) > []*`,
+	`html ((([])*)*)* div`,
+	`html ([]?)* [] ([]*)?`,
+	`html > body > ((div | div) | p)+`,
+	`html (div.x.x | div:not(:not(.x)))`,
+	`html > body > (div > a | div > a)`,
+	`html > (body > div | body > p)?`,
+	`html > body > [] ~ [] <+ []`,
+	`html body (div as d)* a as link`,
+	`html > (head | head) | html > body`,
+}
+
+// optimizeDocs are the trees the optimized programs are checked on, the
+// qq.html fixture and a small document exercising the sibling steps
+func optimizeDocs(t *testing.T) []*Node {
+	nodes, err := ParseString(`
+<html><head><title>t</title></head><body>
+	<div class="x"><a href="1">a</a><p>p</p></div>
+	<p><div><a>b</a></div></p>
+	<div><a href="2">c</a></div>
+</body></html>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(append([]*Node(nil), testNodes...), nodes...)
+}
+
+func TestOptimize(t *testing.T) {
+	docs := optimizeDocs(t)
+	describe := func(matches []map[string]*Node) string {
+		var ret []string
+		for _, caps := range matches {
+			ret = append(ret, fmt.Sprintf("%v", caps))
+		}
+		return strings.Join(ret, " ")
+	}
+	for _, code := range optimizeCodes {
+		raw, err := compile(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		optimized := Optimize(raw)
+		if len(optimized) > len(raw) {
+			t.Fatalf("%s: grew from %d to %d", code, len(raw), len(optimized))
+		}
+		for pc, inst := range optimized {
+			switch inst.Op {
+			case Jump:
+				if optimized[inst.A].Op == Jump || inst.A == pc+1 {
+					t.Fatalf("%s: jump not threaded\n%s", code, optimized)
+				}
+			case Split:
+				if inst.A == inst.B || optimized[inst.A].Op == Jump || optimized[inst.B].Op == Jump {
+					t.Fatalf("%s: split not collapsed\n%s", code, optimized)
+				}
+			}
+		}
+		for _, doc := range docs {
+			want, got := Match(doc, raw), Match(doc, optimized)
+			if len(got) != len(want) {
+				t.Fatalf("%s: got %d matches, want %d\n%s", code, len(got), len(want), optimized)
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("%s: match %d differs", code, i)
+				}
+			}
+			if describe(MatchCaptures(doc, raw)) != describe(MatchCaptures(doc, optimized)) {
+				t.Fatalf("%s: captures differ", code)
+			}
+		}
+	}
+
+	// nested loops and repeated alternatives shrink
+	for _, c := range []struct {
+		code string
+		size int
+	}{
+		{`html ((([])*)*)* div`, 8},
+		{`html > body > ((div | div) | p)+`, 5},
+		{`html (div.x.x | div:not(:not(.x)))`, 4},
+	} {
+		if p := MustCompile(c.code); len(p) != c.size {
+			t.Fatalf("%s: got\n%s", c.code, p)
+		}
+	}
+}
+
+func BenchmarkOptimize(b *testing.B) {
+	var alternatives []string
+	for i := 0; i < 24; i++ {
+		alternatives = append(alternatives, fmt.Sprintf(`(div.c%d | p)* (a | span)+ b?`, i))
+	}
+	raw, err := compile(`html (` + strings.Join(alternatives, " | ") + `)`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if len(raw) > maxReduce {
+		b.Fatalf("%d instructions", len(raw))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Optimize(raw)
+	}
+}
@@ -4,30 +4,155 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
 	"strings"
+	"unicode/utf8"
 
 	"code.google.com/p/go.net/html"
 )
 
+// ParseMode selects how the tree is built from the html
+type ParseMode int
+
+const (
+	// Tokenizer builds the tree straight from the tokens: an element holds
+	// what is between its start and end tags. it is the default.
+	Tokenizer ParseMode = iota
+	// HTML5 builds the tree as browsers do, with the tree construction of
+	// the HTML5 spec: implied html, head, body and tbody, p, li and td
+	// closed by the next ones, foster parenting. Raw is the html the node
+	// renders to, as the tree no longer follows the source, and Pos and
+	// Warnings are left empty.
+	HTML5
+)
+
+// Pos locates a node in the parsed document. it is only filled by the
+// Tokenizer mode.
+type Pos struct {
+	StartTag Span
+	EndTag   Span // empty where the node ends if it has no end tag
+	Inner    Span // between the tags
+}
+
+// Span is a range of the document
+type Span struct {
+	Start, End int // byte offsets, End excluded
+	Line       int // of Start, 1-based
+	Column     int // of Start, 1-based, in runes
+}
+
+type ParseOptions struct {
+	Mode ParseMode
+}
+
+// ParseResult is the tree parsed from a document, with the problems met in
+// the markup
+type ParseResult struct {
+	Nodes    []*Node
+	Warnings []Warning // in document order, only reported by Tokenizer
+}
+
+// Warning is a problem in the markup that the parser recovered from
+type Warning struct {
+	Offset int // byte offset of the end tag, or of the start tag of the element
+	Kind   WarningKind
+	Tag    string
+}
+
+type byOffset []Warning
+
+func (w byOffset) Len() int {
+	return len(w)
+}
+
+func (w byOffset) Less(i, j int) bool {
+	return w[i].Offset < w[j].Offset
+}
+
+func (w byOffset) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("offset %d: %s <%s>", w.Offset, w.Kind, w.Tag)
+}
+
+type WarningKind int
+
+const (
+	OrphanEndTag     WarningKind = iota // closes no element, ignored
+	ImplicitlyClosed                    // closed by the end tag of an ancestor
+	UnclosedElement                     // still open at the end of the document
+)
+
+func (k WarningKind) String() string {
+	switch k {
+	case OrphanEndTag:
+		return "orphan end tag"
+	case ImplicitlyClosed:
+		return "implicitly closed element"
+	case UnclosedElement:
+		return "unclosed element"
+	}
+	return fmt.Sprintf("WarningKind(%d)", int(k))
+}
+
+// ParseWithOptions is like Parse, building the tree as options say, and
+// also returns the warnings
+func ParseWithOptions(r io.Reader, options ParseOptions) (*ParseResult, error) {
+	switch options.Mode {
+	case Tokenizer:
+		return parseTokens(r)
+	case HTML5:
+		return parseHTML5(r)
+	}
+	return nil, fmt.Errorf("unknown parse mode %d", options.Mode)
+}
+
+// Parse returns the top level nodes of the document. an end tag closes the
+// elements opened since its start tag, and is ignored if it has none.
 func Parse(r io.Reader) ([]*Node, error) {
+	result, err := parseTokens(r)
+	if err != nil {
+		return nil, err
+	}
+	return result.Nodes, nil
+}
+
+// parseTokens builds the tree from the tokens. the Raw of every node is a
+// slice of the one copy of the document, so that a node does not cost the
+// size of its subtree again.
+func parseTokens(r io.Reader) (*ParseResult, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	source := string(data)
+	result := new(ParseResult)
 	root := &Node{
-		Tag:    "ROOT",
-		rawBuf: new(bytes.Buffer),
+		Tag: "ROOT",
 	}
-	tokenizer := html.NewTokenizer(r)
+	root.Pos.Inner = Span{0, 0, 1, 1}
+	tokenizer := html.NewTokenizer(strings.NewReader(source))
 	currentNode := root
-	writeRaw := func() {
-		raw := tokenizer.Raw()
-		currentNode.rawBuf.Write(raw)
-		node := currentNode
-		for node.Parent != nil {
-			node = node.Parent
-			node.rawBuf.Write(raw)
-		}
+	warn := func(kind WarningKind, offset int, tag string) {
+		result.Warnings = append(result.Warnings, Warning{offset, kind, tag})
 	}
+	// closeNode ends node at endTag, empty if node has no end tag
+	closeNode := func(node *Node, endTag Span) {
+		node.Pos.EndTag = endTag
+		node.Pos.Inner.End = endTag.Start
+		node.Raw = source[node.Pos.StartTag.Start:endTag.End]
+	}
+	var token Span // of the current token
+	line, column := 1, 1
 parse:
 	for {
 		what := tokenizer.Next()
+		token = Span{token.End, token.End + len(tokenizer.Raw()), line, column}
+		line, column = advance(tokenizer.Raw(), line, column)
+		after := Span{token.End, token.End, line, column} // empty, after the token
 		switch what {
 		case html.ErrorToken:
 			break parse
@@ -36,66 +161,201 @@ parse:
 			if len(text) > 0 {
 				currentNode.Text += text
 				currentNode.TextParts = append(currentNode.TextParts, text)
+				currentNode.textAt = append(currentNode.textAt, len(currentNode.Children))
 			}
-			writeRaw()
-		case html.StartTagToken:
+		case html.StartTagToken, html.SelfClosingTagToken:
 			node := &Node{
 				Parent: currentNode,
-				rawBuf: new(bytes.Buffer),
 				Attr:   make(map[string]string),
+				Pos: Pos{
+					StartTag: token,
+					EndTag:   after,
+					Inner:    after,
+				},
 			}
-			currentNode.Children = append(currentNode.Children, node)
-			currentNode = node
-			writeRaw()
 			name, hasAttr := tokenizer.TagName()
-			currentNode.Tag = string(name)
+			node.Tag = string(name)
 			if hasAttr {
 				key, val, more := tokenizer.TagAttr()
-				currentNode.Attr[string(key)] = string(val)
+				node.Attr[string(key)] = string(val)
 				for more {
 					key, val, more = tokenizer.TagAttr()
-					currentNode.Attr[string(key)] = string(val)
+					node.Attr[string(key)] = string(val)
 				}
 			}
-			currentNode.collectIdAndClass()
+			node.collectIdAndClass()
+			currentNode.Children = append(currentNode.Children, node)
+			if what == html.SelfClosingTagToken || voidElements[node.Tag] { // a leaf
+				node.Raw = source[token.Start:token.End]
+				break
+			}
+			currentNode = node
 		case html.EndTagToken:
 			name, _ := tokenizer.TagName()
-			for string(name) != currentNode.Tag { // skip mismatched tag
-				currentNode.Raw = string(currentNode.rawBuf.Bytes())
+			open := currentNode
+			for open != root && open.Tag != string(name) {
+				open = open.Parent
+			}
+			if open == root { // no start tag to close, like that of a void element
+				warn(OrphanEndTag, token.Start, string(name))
+				break
+			}
+			for currentNode != open { // close the elements opened since
+				warn(ImplicitlyClosed, currentNode.Pos.StartTag.Start, currentNode.Tag)
+				closeNode(currentNode, Span{token.Start, token.Start, token.Line, token.Column})
 				currentNode = currentNode.Parent
-				if currentNode == nil {
-					return nil, fmt.Errorf("start tag not found for end tag %s", name)
-				}
 			}
-			writeRaw()
-			currentNode.Raw = string(currentNode.rawBuf.Bytes())
+			closeNode(currentNode, token)
 			currentNode = currentNode.Parent
-		case html.SelfClosingTagToken:
-			node := &Node{
-				Parent: currentNode,
-				Raw:    string(tokenizer.Raw()),
-				Attr:   make(map[string]string),
+		}
+	}
+	for ; currentNode != root; currentNode = currentNode.Parent {
+		warn(UnclosedElement, currentNode.Pos.StartTag.Start, currentNode.Tag)
+		closeNode(currentNode, token)
+	}
+	closeNode(root, token)
+	// elements are closed from the innermost, after what they hold
+	sort.Stable(byOffset(result.Warnings))
+	result.Nodes = root.Children
+	return result, nil
+}
+
+// advance returns the line and column after b, starting at line and column
+func advance(b []byte, line, column int) (int, int) {
+	for _, c := range b {
+		if c == '\n' {
+			line++
+			column = 1
+		} else if utf8.RuneStart(c) {
+			column++
+		}
+	}
+	return line, column
+}
+
+func parseHTML5(r io.Reader) (*ParseResult, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	// the document is rendered once, as html.Render does, and the Raw of
+	// each element is sliced from it
+	var buf bytes.Buffer
+	type span struct {
+		node       *Node
+		start, end int
+	}
+	var spans []span
+	stop := false // after a plaintext element, nothing is rendered
+	var build func(node *Node, n *html.Node)
+	build = func(node *Node, n *html.Node) {
+		literal := n.Type == html.ElementNode && n.Namespace == "" && literalText[n.Data]
+		if c := n.FirstChild; c != nil && c.Type == html.TextNode && strings.HasPrefix(c.Data, "\n") {
+			switch n.Data {
+			case "pre", "listing", "textarea": // the first newline is dropped by parsers
+				buf.WriteByte('\n')
 			}
-			name, hasAttr := tokenizer.TagName()
-			node.Tag = string(name)
-			if hasAttr {
-				key, val, more := tokenizer.TagAttr()
-				node.Attr[string(key)] = string(val)
-				for more {
-					key, val, more = tokenizer.TagAttr()
-					node.Attr[string(key)] = string(val)
+		}
+		for c := n.FirstChild; c != nil && !stop; c = c.NextSibling {
+			switch c.Type {
+			case html.TextNode:
+				if literal {
+					buf.WriteString(c.Data)
+				} else {
+					html.Render(&buf, &html.Node{Type: html.TextNode, Data: c.Data})
+				}
+				text := strings.TrimSpace(c.Data)
+				if len(text) > 0 {
+					node.Text += text
+					node.TextParts = append(node.TextParts, text)
+					node.textAt = append(node.textAt, len(node.Children))
+				}
+			case html.ElementNode:
+				child := &Node{
+					Parent: node,
+					Tag:    c.Data,
+					Attr:   make(map[string]string),
+				}
+				for _, attr := range c.Attr {
+					key := attr.Key
+					if attr.Namespace != "" {
+						key = attr.Namespace + ":" + key
+					}
+					if _, ok := child.Attr[key]; !ok { // the first one wins
+						child.Attr[key] = attr.Val
+					}
+				}
+				child.collectIdAndClass()
+				node.Children = append(node.Children, child)
+				start := buf.Len()
+				// the tags of the element without its children
+				html.Render(&buf, &html.Node{
+					Type:      html.ElementNode,
+					DataAtom:  c.DataAtom,
+					Data:      c.Data,
+					Namespace: c.Namespace,
+					Attr:      c.Attr,
+				})
+				endTag := "</" + c.Data + ">"
+				if bytes.HasSuffix(buf.Bytes(), []byte(endTag)) { // plaintext has none
+					buf.Truncate(buf.Len() - len(endTag))
 				}
+				if !bytes.HasSuffix(buf.Bytes(), []byte("/>")) { // not void
+					build(child, c)
+					if !stop {
+						buf.WriteString(endTag)
+					}
+				}
+				spans = append(spans, span{child, start, buf.Len()})
+			default:
+				html.Render(&buf, &html.Node{Type: c.Type, Data: c.Data, Attr: c.Attr})
 			}
-			node.collectIdAndClass()
-			currentNode.Children = append(currentNode.Children, node)
-			writeRaw()
-		case html.CommentToken:
-			writeRaw()
 		}
+		if literal && n.Data == "plaintext" {
+			stop = true
+		}
+	}
+	root := &Node{
+		Tag: "ROOT",
+	}
+	build(root, doc)
+	source := buf.String()
+	root.Raw = source
+	for _, s := range spans {
+		s.node.Raw = source[s.start:s.end]
 	}
-	root.Raw = string(root.rawBuf.Bytes())
+	return &ParseResult{Nodes: root.Children}, nil
+}
+
+// literalText are the elements whose text html.Render writes unescaped
+var literalText = map[string]bool{
+	"iframe":    true,
+	"noembed":   true,
+	"noframes":  true,
+	"noscript":  true,
+	"plaintext": true,
+	"script":    true,
+	"style":     true,
+	"xmp":       true,
+}
 
-	return root.Children, nil
+// voidElements have no content and no end tag, <br> is a leaf as <br/> is
+var voidElements = map[string]bool{
+	"area":   true,
+	"base":   true,
+	"br":     true,
+	"col":    true,
+	"embed":  true,
+	"hr":     true,
+	"img":    true,
+	"input":  true,
+	"keygen": true,
+	"link":   true,
+	"meta":   true,
+	"param":  true,
+	"source": true,
+	"track":  true,
+	"wbr":    true,
 }
 
 func (n *Node) collectIdAndClass() {
@@ -1,8 +1,12 @@
 package nm
 
 import (
+	"bytes"
+	"fmt"
 	"strings"
 	"testing"
+
+	"code.google.com/p/go.net/html"
 )
 
 const testHtml = `
@@ -223,9 +227,303 @@ func TestParseTagMismatched(t *testing.T) {
 	}
 }
 
-func TestParseBadTag(t *testing.T) {
-	_, err := ParseString(`<p></a>`)
-	if err == nil || err.Error() != "start tag not found for end tag a" {
-		t.Fatalf("allowing tag mismatched")
+func TestParseRecovery(t *testing.T) {
+	const doc = `<p></a>x</p><div><span><b>y</div></div><br></br><ul><li>z`
+	result, err := ParseWithOptions(strings.NewReader(doc), ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, n := range result.Nodes {
+		got = append(got, n.Tag+"="+n.Raw)
+	}
+	if want := "p=<p></a>x</p> div=<div><span><b>y</div> br=<br> ul=<ul><li>z"; strings.Join(got, " ") != want {
+		t.Fatalf("got %s", strings.Join(got, " "))
+	}
+	li := result.Nodes[3].Children[0]
+	if li.Tag != "li" || li.Text != "z" || li.Raw != "<li>z" {
+		t.Fatalf("li %s %q", li.Tag, li.Raw)
+	}
+	got = got[:0]
+	for _, w := range result.Warnings {
+		got = append(got, w.String())
+	}
+	want := []string{
+		"offset 3: orphan end tag <a>",
+		"offset 17: implicitly closed element <span>",
+		"offset 23: implicitly closed element <b>",
+		"offset 33: orphan end tag <div>",
+		"offset 43: orphan end tag <br>",
+		"offset 48: unclosed element <ul>",
+		"offset 52: unclosed element <li>",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got warnings\n%s", strings.Join(got, "\n"))
+	}
+	for _, w := range result.Warnings {
+		if doc[w.Offset] != '<' {
+			t.Fatalf("%v: not at a tag", w)
+		}
+	}
+
+	// Parse recovers the same way
+	nodes, err := ParseString(doc)
+	if err != nil || len(nodes) != 4 {
+		t.Fatalf("parse %v", err)
+	}
+}
+
+func TestParseHTML5(t *testing.T) {
+	const doc = `<title>t</title>
+<table><div>fostered</div><tr><td>1<td>2</table>
+<p>a<p>b
+<ul><li>x<li>y</ul>`
+	result, err := ParseWithOptions(strings.NewReader(doc), ParseOptions{Mode: HTML5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := result.Nodes
+	if len(nodes) != 1 || nodes[0].Tag != "html" {
+		t.Fatal("no html element")
+	}
+	root := nodes[0].Parent
+	paths := func(code string) (ret []string) {
+		for _, n := range Match(root, MustCompile(code)) {
+			ret = append(ret, strings.Join(n.TagPath(), ">")+"="+n.Text)
+		}
+		return
+	}
+	for code, want := range map[string]string{
+		`ROOT > html > head > title`:                   "html>head>title=t",
+		`ROOT > html > body > table > tbody > tr > td`: "html>body>table>tbody>tr>td=1 html>body>table>tbody>tr>td=2",
+		`ROOT > html > body > table <+ div`:            "html>body>div=fostered",
+		`ROOT > html > body > p`:                       "html>body>p=a html>body>p=b",
+		`ROOT > html > body > ul > li`:                 "html>body>ul>li=x html>body>ul>li=y",
+	} {
+		if got := strings.Join(paths(code), " "); got != want {
+			t.Fatalf("%s: got %s, want %s", code, got, want)
+		}
+	}
+	td := Match(root, MustCompile(`... td`))[0]
+	if td.Raw != "<td>1</td>" {
+		t.Fatalf("raw %q", td.Raw)
+	}
+
+	// the tokenizer mode stays the default
+	nodes, err = ParseString(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes[0].Tag != "title" {
+		t.Fatal("default mode")
+	}
+	if _, err := ParseWithOptions(strings.NewReader(doc), ParseOptions{Mode: 5}); err == nil {
+		t.Fatal("unknown mode")
+	}
+}
+
+func TestParseHTML5Raw(t *testing.T) {
+	const doc = `<!DOCTYPE html><title>a &amp; b</title>
+<script>if (a < b) {}</script><style>p > a {}</style>
+<!-- note --><pre>
+x</pre><textarea>
+
+y</textarea>
+<p title='"q"'>1 &lt; 2<br>&nbsp;<svg viewBox="0 0 1 1"><path d="M0"/></svg>
+<noscript><b>n</b></noscript><plaintext><i>rest</i>`
+	result, err := ParseWithOptions(strings.NewReader(doc), ParseOptions{Mode: HTML5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := html.Parse(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func(n *html.Node) string {
+		var buf bytes.Buffer
+		html.Render(&buf, n)
+		return buf.String()
+	}
+	// Raw is what html.Render gives for each element
+	var check func(node *Node, n *html.Node)
+	check = func(node *Node, n *html.Node) {
+		if want := render(n); node.Raw != want {
+			t.Fatalf("%s: raw %q, want %q", node.Tag, node.Raw, want)
+		}
+		i := 0
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode {
+				check(node.Children[i], c)
+				i++
+			}
+		}
+		if i != len(node.Children) {
+			t.Fatalf("%s: %d children, want %d", node.Tag, len(node.Children), i)
+		}
+	}
+	check(result.Nodes[0].Parent, tree)
+	if len(result.Warnings) != 0 || result.Nodes[0].Pos != (Pos{}) {
+		t.Fatal("pos or warnings in HTML5 mode")
+	}
+}
+
+func TestParseVoidElements(t *testing.T) {
+	nodes, err := ParseString(`<html><head>
+<meta charset="utf-8"><link rel="stylesheet" href="a.css">
+<title>T</title>
+</head><body>
+<form><input name="q"><input type="submit"></form>
+<p>one<br>two<BR>three</p>
+<div><img src="a.png"><span>caption</span><img src="b.png"></img><hr></div>
+<footer>f</footer>
+</body></html>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := nodes[0].Parent
+	for code, want := range map[string]string{
+		`ROOT > html > head > []`:        "html>head>meta:0 html>head>link:1 html>head>title:2",
+		`ROOT > html > body > []`:        "html>body>form:0 html>body>p:1 html>body>div:2 html>body>footer:3",
+		`ROOT > html > body > form > []`: "html>body>form>input:0 html>body>form>input:1",
+		`ROOT > html > body > p > []`:    "html>body>p>br:0 html>body>p>br:1",
+		`ROOT > html > body > div > []`:  "html>body>div>img:0 html>body>div>span:1 html>body>div>img:2 html>body>div>hr:3",
+		`ROOT > html > body > footer`:    "html>body>footer:3",
+		`... span`:                       "html>body>div>span:1",
+	} {
+		var got []string
+		for _, n := range Match(root, MustCompile(code)) {
+			got = append(got, fmt.Sprintf("%s:%d", strings.Join(n.TagPath(), ">"), n.Index()))
+		}
+		if strings.Join(got, " ") != want {
+			t.Fatalf("%s: got %s, want %s", code, strings.Join(got, " "), want)
+		}
+	}
+	for _, n := range Match(root, MustCompile(`... (br | img | input | meta | hr)`)) {
+		if len(n.Children) != 0 || n.Raw == "" || strings.Contains(n.Raw, "</") || strings.Count(n.Raw, "<") != 1 {
+			t.Fatalf("%s: raw %q", n.Tag, n.Raw)
+		}
+	}
+	p := Match(root, MustCompile(`... p`))[0]
+	if p.Raw != "<p>one<br>two<BR>three</p>" || p.Text != "onetwothree" {
+		t.Fatalf("p raw %q text %q", p.Raw, p.Text)
+	}
+}
+
+func TestParsePos(t *testing.T) {
+	const doc = `<html>
+<body>
+	<p class="é">héllo <b>wörld</b></p>
+	<img src="x"><br/>
+	<div><span>open
+</div>
+</body>
+</html>`
+	nodes, err := ParseString(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var check func(n *Node)
+	check = func(n *Node) {
+		pos := n.Pos
+		for _, span := range []Span{pos.StartTag, pos.EndTag, pos.Inner} {
+			line, column := lineColumn(doc, span.Start)
+			if span.Line != line || span.Column != column {
+				t.Fatalf("%s: span %v at %d:%d", n.Tag, span, line, column)
+			}
+		}
+		if pos.StartTag.End != pos.Inner.Start || pos.Inner.End != pos.EndTag.Start {
+			t.Fatalf("%s: spans not contiguous %v", n.Tag, pos)
+		}
+		if got := doc[pos.StartTag.Start:pos.EndTag.End]; got != n.Raw {
+			t.Fatalf("%s: source %q, raw %q", n.Tag, got, n.Raw)
+		}
+		for _, c := range n.Children {
+			check(c)
+		}
+	}
+	for _, n := range nodes {
+		check(n)
+	}
+
+	b := Match(nodes[0], MustCompile(`... b`))[0]
+	if b.Pos.StartTag.Line != 3 || b.Pos.StartTag.Column != 21 ||
+		doc[b.Pos.Inner.Start:b.Pos.Inner.End] != "wörld" ||
+		doc[b.Pos.EndTag.Start:b.Pos.EndTag.End] != "</b>" {
+		t.Fatalf("b pos %+v", b.Pos)
+	}
+	img := Match(nodes[0], MustCompile(`... img`))[0]
+	if doc[img.Pos.StartTag.Start:img.Pos.StartTag.End] != `<img src="x">` ||
+		img.Pos.EndTag.Start != img.Pos.StartTag.End || img.Pos.EndTag.End != img.Pos.EndTag.Start {
+		t.Fatalf("img pos %+v", img.Pos)
+	}
+	span := Match(nodes[0], MustCompile(`... span`))[0] // closed by </div>
+	if span.Pos.EndTag.Line != 6 || span.Pos.EndTag.Column != 1 ||
+		span.Pos.EndTag.Start != span.Pos.EndTag.End || doc[span.Pos.EndTag.Start:][:6] != "</div>" {
+		t.Fatalf("span pos %+v", span.Pos)
+	}
+}
+
+// deepDoc is nested divs, whose raw used to be copied once per ancestor
+func deepDoc(depth int) string {
+	text := strings.Repeat("x", 100)
+	return strings.Repeat("<div>"+text, depth) + strings.Repeat("</div>", depth)
+}
+
+func TestParseRawShared(t *testing.T) {
+	const depth = 2000
+	doc := deepDoc(depth)
+	nodes, err := ParseString(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the raw of every node is where the node is in the document
+	var check func(n *Node)
+	check = func(n *Node) {
+		if n.Raw != doc[n.Pos.StartTag.Start:n.Pos.EndTag.End] {
+			t.Fatalf("%s: raw not at %v", n.Tag, n.Pos)
+		}
+		for _, c := range n.Children {
+			check(c)
+		}
+	}
+	check(nodes[0].Parent)
+	if nodes[0].Raw != doc || len(Match(nodes[0], MustCompile(`... div`))) != depth {
+		t.Fatal("raw")
+	}
+
+	result, err := ParseWithOptions(strings.NewReader(doc), ParseOptions{Mode: HTML5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := result.Nodes[0].Parent
+	check = func(n *Node) {
+		if !strings.Contains(root.Raw, n.Raw) {
+			t.Fatalf("%s: raw not in the document", n.Tag)
+		}
+		for _, c := range n.Children {
+			check(c)
+		}
+	}
+	check(root)
+}
+
+// BenchmarkParseDeep reports the bytes allocated for a document whose raw
+// would cost its size once per level if copied
+func BenchmarkParseDeep(b *testing.B) {
+	doc := deepDoc(2000)
+	for _, mode := range []ParseMode{Tokenizer, HTML5} {
+		name := "tokenizer"
+		if mode == HTML5 {
+			name = "html5"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(doc)))
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseWithOptions(strings.NewReader(doc), ParseOptions{Mode: mode}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
 	}
 }
@@ -0,0 +1,225 @@
+package nm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Pred is a node predicate. predicates are plain data rather than closures,
+// so compiled programs can be stored and inspected.
+type Pred struct {
+	Op     PredOp
+	Name   string  `json:",omitempty"` // tag, id, class, attribute key, pseudo class, or text or textpart
+	AttrOp string  `json:",omitempty"` // attribute operator, empty for existence
+	Value  string  `json:",omitempty"` // attribute or text value, or the regexp of =~
+	A, B   int     `json:",omitempty"` // an+b of nth pseudo classes
+	Subs   []*Pred `json:",omitempty"` // operands of PredNot, PredAnd and PredOr
+
+	re     *regexp.Regexp // compiled Value of =~
+	reOnce sync.Once      // compiles re of predicates built by hand
+}
+
+type PredOp int
+
+const (
+	PredAny PredOp = iota
+	PredTag
+	PredId
+	PredClass
+	PredAttr
+	PredPseudo
+	PredNot
+	PredAnd
+	PredOr
+	PredText // Name text or textpart, AttrOp =, =~ or for text *=
+)
+
+// Match reports whether n satisfies the predicate
+func (p *Pred) Match(n *Node) bool {
+	switch p.Op {
+	case PredAny:
+		return true
+	case PredTag:
+		return n.Tag == p.Name
+	case PredId:
+		return n.Id == p.Name
+	case PredClass:
+		for _, cls := range n.Class {
+			if cls == p.Name {
+				return true
+			}
+		}
+		return false
+	case PredAttr:
+		return p.matchAttr(n)
+	case PredPseudo:
+		return matchPseudo(p.Name, p.A, p.B, n)
+	case PredText:
+		return p.matchText(n)
+	case PredNot:
+		return !p.Subs[0].Match(n)
+	case PredAnd:
+		for _, sub := range p.Subs {
+			if !sub.Match(n) {
+				return false
+			}
+		}
+		return true
+	case PredOr:
+		for _, sub := range p.Subs {
+			if sub.Match(n) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// String returns the predicate in pattern syntax
+func (p *Pred) String() string {
+	switch p.Op {
+	case PredAny:
+		return "[]"
+	case PredTag:
+		return p.Name
+	case PredId:
+		return "#" + p.Name
+	case PredClass:
+		return "." + p.Name
+	case PredPseudo:
+		if nthPseudo(p.Name) {
+			if p.A == 0 {
+				return fmt.Sprintf(":%s(%d)", p.Name, p.B)
+			}
+			return fmt.Sprintf(":%s(%dn%+d)", p.Name, p.A, p.B)
+		}
+		return ":" + p.Name
+	case PredText:
+		return p.textString()
+	}
+	if expr, ok := p.attrExpr(); ok {
+		return "[" + expr + "]"
+	}
+	switch p.Op {
+	case PredNot:
+		return ":not(" + p.Subs[0].alternation() + ")"
+	case PredOr:
+		return "(" + p.alternation() + ")"
+	case PredAnd:
+		return p.intersection()
+	}
+	return p.Op.String()
+}
+
+// alternation returns the predicate as the operand of :not or (), the
+// alternatives of PredOr without parentheses
+func (p *Pred) alternation() string {
+	if !p.isAlternation() {
+		return p.String()
+	}
+	parts := make([]string, len(p.Subs))
+	for i, sub := range p.Subs {
+		parts[i] = sub.String()
+	}
+	return strings.Join(parts, " | ")
+}
+
+// isAlternation reports whether the predicate prints as alternatives in
+// parentheses rather than as an attribute expression
+func (p *Pred) isAlternation() bool {
+	if p.Op != PredOr {
+		return false
+	}
+	_, ok := p.attrExpr()
+	return !ok
+}
+
+// intersection returns PredAnd in pattern syntax, the operands in order. a
+// tag runs into the name before it unless that ends with ] or ), so the
+// operands before it are grouped. an alternation can only come first, the
+// others are put under :not(:not()); parsing gives no such intersection.
+func (p *Pred) intersection() string {
+	var ops []*Pred
+	var flatten func(p *Pred)
+	flatten = func(p *Pred) {
+		_, attrs := p.attrExpr()
+		switch {
+		case p.Op == PredAnd && !attrs:
+			for _, sub := range p.Subs {
+				flatten(sub)
+			}
+		case p.Op == PredAny:
+		default:
+			ops = append(ops, p)
+		}
+	}
+	flatten(p)
+	if len(ops) == 0 {
+		return "[]"
+	}
+	out := ops[0].String()
+	for _, op := range ops[1:] {
+		switch {
+		case op.Op == PredTag && (strings.HasSuffix(out, "]") || strings.HasSuffix(out, ")")):
+			out += op.String()
+		case op.Op == PredTag:
+			out = "(" + out + ")" + op.String()
+		case op.isAlternation():
+			out += ":not(:not(" + op.alternation() + "))"
+		default:
+			out += op.String()
+		}
+	}
+	return out
+}
+
+// check validates a predicate read from outside, compiling its regexps
+func (p *Pred) check() error {
+	if p == nil {
+		return fmt.Errorf("missing predicate")
+	}
+	switch p.Op {
+	case PredAny, PredTag, PredId, PredClass:
+	case PredAttr:
+		if p.AttrOp != "" && !validAttrOp(p.AttrOp) {
+			return fmt.Errorf("unknown attribute operator %q", p.AttrOp)
+		}
+		if p.AttrOp == "=~" {
+			re, err := regexp.Compile(p.Value)
+			if err != nil {
+				return err
+			}
+			p.re = re
+		}
+	case PredPseudo:
+		if !plainPseudo(p.Name) && !nthPseudo(p.Name) {
+			return fmt.Errorf("unknown pseudo class %q", p.Name)
+		}
+	case PredText:
+		if !validTextOp(p.Name, p.AttrOp) {
+			return fmt.Errorf("unknown text operator %q of %s", p.AttrOp, p.Name)
+		}
+		if p.AttrOp == "=~" {
+			re, err := regexp.Compile(p.Value)
+			if err != nil {
+				return err
+			}
+			p.re = re
+		}
+	case PredNot, PredAnd, PredOr:
+		if len(p.Subs) == 0 || p.Op == PredNot && len(p.Subs) != 1 {
+			return fmt.Errorf("%v with %d operands", p.Op, len(p.Subs))
+		}
+		for _, sub := range p.Subs {
+			if err := sub.check(); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown predicate op %d", p.Op)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package nm
+
+import (
+	"strconv"
+	"strings"
+)
+
+// genPseudo returns the predicate of pseudo class :name or :name(arg), or
+// nil if there is no such class
+func genPseudo(name, arg string) (*Pred, error) {
+	if arg == "" && !plainPseudo(name) || arg != "" && !nthPseudo(name) {
+		return nil, nil
+	}
+	p := &Pred{Op: PredPseudo, Name: name}
+	if arg != "" {
+		var err error
+		if p.A, p.B, err = parseNth(arg); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// plainPseudo reports whether name is a pseudo class without argument
+func plainPseudo(name string) bool {
+	switch name {
+	case "first", "last", "only-child", "empty":
+		return true
+	}
+	return false
+}
+
+// nthPseudo reports whether name is a pseudo class taking an+b
+func nthPseudo(name string) bool {
+	switch name {
+	case "nth", "nth-last", "nth-of-type", "nth-last-of-type":
+		return true
+	}
+	return false
+}
+
+// matchPseudo reports whether n is in pseudo class name, a and b being the
+// an+b of nth classes. positions are 1-based and counted among the children
+// of the parent node.
+func matchPseudo(name string, a, b int, n *Node) bool {
+	switch name {
+	case "first":
+		return n.position() == 1
+	case "last":
+		return n.position() == len(n.siblings())
+	case "only-child":
+		return len(n.siblings()) == 1
+	case "empty":
+		return len(n.Children) == 0 && n.Text == ""
+	case "nth":
+		return nthMatch(a, b, n.position())
+	case "nth-last":
+		return nthMatch(a, b, len(n.siblings())-n.position()+1)
+	case "nth-of-type":
+		pos, _ := n.typePosition()
+		return nthMatch(a, b, pos)
+	case "nth-last-of-type":
+		pos, count := n.typePosition()
+		return nthMatch(a, b, count-pos+1)
+	}
+	return false
+}
+
+// parseNth parses an+b, odd, even or a plain integer. the syntax is checked
+// by the grammar, so the error is that of a number out of range.
+func parseNth(s string) (a, b int, err error) {
+	s = strings.Join(strings.Fields(s), "")
+	switch s {
+	case "odd":
+		return 2, 1, nil
+	case "even":
+		return 2, 0, nil
+	}
+	i := strings.IndexByte(s, 'n')
+	if i < 0 {
+		b, err = strconv.Atoi(s)
+		return 0, b, err
+	}
+	switch s[:i] {
+	case "", "+":
+		a = 1
+	case "-":
+		a = -1
+	default:
+		if a, err = strconv.Atoi(s[:i]); err != nil {
+			return
+		}
+	}
+	if i+1 < len(s) {
+		b, err = strconv.Atoi(strings.TrimPrefix(s[i+1:], "+"))
+	}
+	return
+}
+
+// nthMatch reports whether pos is a*k+b for some k >= 0
+func nthMatch(a, b, pos int) bool {
+	if a == 0 {
+		return pos == b
+	}
+	diff := pos - b
+	return diff%a == 0 && diff/a >= 0
+}
+
+// siblings returns the children of the parent, or n alone if n has no parent
+func (n *Node) siblings() []*Node {
+	if n.Parent == nil {
+		return []*Node{n}
+	}
+	return n.Parent.Children
+}
+
+func (n *Node) position() int {
+	if n.Parent == nil {
+		return 1
+	}
+	return n.Index() + 1
+}
+
+// typePosition returns the position of n among siblings with the same tag,
+// and the number of those siblings
+func (n *Node) typePosition() (pos, count int) {
+	for _, sibling := range n.siblings() {
+		if sibling.Tag != n.Tag {
+			continue
+		}
+		count++
+		if sibling == n {
+			pos = count
+		}
+	}
+	return
+}
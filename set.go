@@ -0,0 +1,119 @@
+package nm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PatternSet is a set of patterns compiled into one program, so that one
+// pass over a tree matches them all
+type PatternSet struct {
+	Patterns []string
+	Program  Program // the Ok of each pattern holds its index in A
+}
+
+// SetMatch is a node matched by some patterns of a PatternSet
+type SetMatch struct {
+	Node     *Node
+	Patterns []int // indexes of the patterns matched, ascending
+}
+
+// PatternError reports a pattern of a set that does not compile
+type PatternError struct {
+	Index   int // of the pattern in the set
+	Pattern string
+	Err     error // a *SyntaxError or a *CompileError
+}
+
+func (e *PatternError) Error() string {
+	return fmt.Sprintf("pattern %d %q: %v", e.Index, e.Pattern, e.Err)
+}
+
+func (e *PatternError) Unwrap() error {
+	return e.Err
+}
+
+// CompileSet compiles patterns into a PatternSet. the error is a
+// *PatternError about the first pattern not compiling.
+func CompileSet(patterns ...string) (*PatternSet, error) {
+	var program Program
+	// a chain of splits starts every pattern
+	for i := range patterns {
+		if i < len(patterns)-1 {
+			program = append(program, Inst{Split, nil, 0, i + 1, ""})
+		} else {
+			program = append(program, Inst{Jump, nil, 0, 0, ""})
+		}
+	}
+	for i, code := range patterns {
+		p, err := compile(code)
+		if err != nil {
+			return nil, &PatternError{i, code, err}
+		}
+		base := len(program)
+		program[i].A = base
+		for _, inst := range p {
+			switch inst.Op {
+			case Unanchored: // restarts only this pattern, at every node
+				inst.Op = Descend
+			case Ok:
+				inst.A = i
+			case Jump:
+				inst.A += base
+			case Split:
+				inst.A += base
+				inst.B += base
+			}
+			program = append(program, inst)
+		}
+	}
+	if len(program) == 0 {
+		program = Program{{Jump, nil, 0, 0, ""}} // matches nothing
+	}
+	return &PatternSet{
+		Patterns: patterns,
+		Program:  Optimize(program),
+	}, nil
+}
+
+func MustCompileSet(patterns ...string) *PatternSet {
+	set, err := CompileSet(patterns...)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// Match returns the nodes in the tree rooted at node matched by any pattern
+// of the set, in document order
+func (s *PatternSet) Match(node *Node) []SetMatch {
+	return MatchSet(node, s.Program)
+}
+
+// MatchSet is like Match but reports, for each matched node, the indexes
+// held by the Ok instructions the node reached, as for a PatternSet
+func MatchSet(node *Node, program Program) []SetMatch {
+	m := newMatcher(program, false)
+	m.set = true
+	m.walk(node, 0)
+	ret := make([]SetMatch, len(m.result))
+	for i, n := range m.result {
+		ret[i] = SetMatch{
+			Node:     n,
+			Patterns: m.patterns[i],
+		}
+	}
+	return ret
+}
+
+// addPattern inserts id in the ascending ids if not there
+func addPattern(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
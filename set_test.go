@@ -0,0 +1,80 @@
+package nm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPatternSet(t *testing.T) {
+	patterns := []string{
+		`html > body > div`,
+		`... a`,
+		`html body div a`,
+		`// div a[href]`,
+		`html > body > div > a + p`,
+		`html > body > div > p <+ a`,
+		`html body (div as d)* a as link`,
+		`... div.x`,
+	}
+	set := MustCompileSet(patterns...)
+	for _, doc := range optimizeDocs(t) {
+		want := make(map[*Node][]int)
+		var order []*Node
+		for i, code := range patterns {
+			for _, n := range Match(doc, MustCompile(code)) {
+				if want[n] == nil {
+					order = append(order, n)
+				}
+				want[n] = append(want[n], i)
+			}
+		}
+		got := set.Match(doc)
+		if len(got) != len(order) {
+			t.Fatalf("got %d matches, want %d\n%s", len(got), len(order), set.Program)
+		}
+		for _, m := range got {
+			if fmt.Sprint(m.Patterns) != fmt.Sprint(want[m.Node]) {
+				t.Fatalf("%v: got patterns %v, want %v", m.Node.TagPath(), m.Patterns, want[m.Node])
+			}
+		}
+		position := documentOrder(doc)
+		for i := 1; i < len(got); i++ {
+			if position[got[i-1].Node] >= position[got[i].Node] {
+				t.Fatal("not in document order")
+			}
+		}
+	}
+
+	if len(MustCompileSet().Match(testNodes[0])) != 0 {
+		t.Fatal("empty set")
+	}
+	_, err := CompileSet(`html`, `html >`, `a[`)
+	e, ok := err.(*PatternError)
+	if !ok || e.Index != 1 || e.Pattern != `html >` {
+		t.Fatalf("bad pattern: %v", err)
+	}
+	var syntax *SyntaxError
+	if !errors.As(err, &syntax) || syntax.Offset != 6 {
+		t.Fatalf("bad pattern: %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), `pattern 1 "html >": invalid expression at line 1 column 7`) {
+		t.Fatalf("message: %v", err)
+	}
+}
+
+// documentOrder returns the position of each node of the tree in document
+// order
+func documentOrder(root *Node) map[*Node]int {
+	order := make(map[*Node]int)
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		order[node] = len(order)
+		for _, c := range node.Children {
+			walk(c)
+		}
+	}
+	walk(root)
+	return order
+}
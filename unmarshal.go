@@ -0,0 +1,262 @@
+package nm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UnmarshalError reports a field that could not be filled
+type UnmarshalError struct {
+	Field string // path of the field from the top struct, like Items[1].Price
+	Err   error
+}
+
+func (e *UnmarshalError) Error() string {
+	return "field " + e.Field + ": " + e.Err.Error()
+}
+
+// Unmarshal fills the struct pointed to by v with the nodes under node
+// matched by the nm tags of its fields. a tag is a pattern searched for
+// among the descendants of node, optionally followed by @attr to take an
+// attribute instead of the text, or by ,text to take the text of the node
+// and all its descendants instead of Node.Text:
+//
+//	Title string    `nm:"h1.title"`
+//	Next  string    `nm:"a.next@href"`
+//	Items []string  `nm:"ul li,text"`
+//	Date  time.Time `nm:"time@datetime" layout:"2006-01-02"`
+//
+// strings, bools, ints, uints, floats, time.Duration and time.Time are
+// parsed from the value, time.Time with the layout tag or time.RFC3339.
+// a struct field is filled from the matched node, so nested structs
+// describe repeated blocks when used in slices. scalars and structs take
+// the first match and are left alone if nothing matches, slices take all
+// matches. fields without a tag are skipped.
+func Unmarshal(node *Node, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("Unmarshal needs a non-nil pointer to a struct")
+	}
+	return unmarshalStruct(node, rv.Elem())
+}
+
+// field is a tagged struct field, compiled once per struct type
+type field struct {
+	index   int
+	name    string
+	program Program
+	attr    string
+	deep    bool // ,text
+	layout  string
+}
+
+var (
+	fieldsLock  sync.Mutex
+	fieldsCache = make(map[reflect.Type][]field)
+)
+
+var attrSuffix = regexp.MustCompile(`@([a-zA-Z0-9-_:]+)$`)
+
+func structFields(t reflect.Type) ([]field, error) {
+	fieldsLock.Lock()
+	fields, ok := fieldsCache[t]
+	fieldsLock.Unlock()
+	if ok {
+		return fields, nil
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("nm")
+		if tag == "" || f.PkgPath != "" { // untagged or unexported
+			continue
+		}
+		info := field{
+			index:  i,
+			name:   f.Name,
+			layout: f.Tag.Get("layout"),
+		}
+		if strings.HasSuffix(tag, ",text") {
+			tag = strings.TrimSuffix(tag, ",text")
+			info.deep = true
+		}
+		if m := attrSuffix.FindStringSubmatchIndex(tag); m != nil {
+			info.attr = tag[m[2]:m[3]]
+			tag = tag[:m[0]]
+		}
+		if info.layout == "" {
+			info.layout = time.RFC3339
+		}
+		if !strings.HasPrefix(tag, "...") && !strings.HasPrefix(tag, "//") {
+			tag = "... " + tag
+		}
+		program, err := Compile(tag)
+		if err != nil {
+			return nil, &UnmarshalError{f.Name, err}
+		}
+		info.program = program
+		fields = append(fields, info)
+	}
+	fieldsLock.Lock()
+	fieldsCache[t] = fields
+	fieldsLock.Unlock()
+	return fields, nil
+}
+
+func unmarshalStruct(node *Node, v reflect.Value) error {
+	fields, err := structFields(v.Type())
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		var matches []*Node
+		for _, child := range node.Children {
+			matches = append(matches, Match(child, f.program)...)
+		}
+		if err := f.fill(v.Field(f.index), matches); err != nil {
+			if e, ok := err.(*UnmarshalError); ok { // from an element or nested field
+				return &UnmarshalError{f.name + e.Field, e.Err}
+			}
+			return &UnmarshalError{f.name, err}
+		}
+	}
+	return nil
+}
+
+func (f *field) fill(v reflect.Value, matches []*Node) error {
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		slice := reflect.MakeSlice(v.Type(), len(matches), len(matches))
+		for i, node := range matches {
+			if err := f.fillOne(slice.Index(i), node); err != nil {
+				if e, ok := err.(*UnmarshalError); ok {
+					return &UnmarshalError{fmt.Sprintf("[%d]%s", i, e.Field), e.Err}
+				}
+				return &UnmarshalError{fmt.Sprintf("[%d]", i), err}
+			}
+		}
+		v.Set(slice)
+		return nil
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	return f.fillOne(v, matches[0])
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (f *field) fillOne(v reflect.Value, node *Node) error {
+	if v.Kind() == reflect.Ptr {
+		elem := reflect.New(v.Type().Elem())
+		if err := f.fillOne(elem.Elem(), node); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	}
+	if v.Kind() == reflect.Struct && v.Type() != timeType {
+		if err := unmarshalStruct(node, v); err != nil {
+			e := err.(*UnmarshalError)
+			return &UnmarshalError{"." + e.Field, e.Err}
+		}
+		return nil
+	}
+	var s string
+	switch {
+	case f.attr != "":
+		s = node.Attr[f.attr]
+	case f.deep:
+		s = deepText(node)
+	default:
+		s = node.Text
+	}
+	return setValue(v, s, f.layout)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setValue(v reflect.Value, s, layout string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Type() == durationType {
+			d, err := time.ParseDuration(strings.TrimSpace(s))
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(d))
+			return nil
+		}
+		i, err := strconv.ParseInt(strings.TrimSpace(s), 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(strings.TrimSpace(s), 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+		return nil
+	case reflect.Slice: // []byte
+		v.SetBytes([]byte(s))
+		return nil
+	case reflect.Struct:
+		if v.Type() == timeType {
+			t, err := time.Parse(layout, strings.TrimSpace(s))
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(t))
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported type %s", v.Type())
+}
+
+// deepText returns the text of node and its descendants in document order,
+// with the parts joined by single spaces. the text parts of a node built by
+// hand, without their places among the children, come before the children.
+func deepText(node *Node) string {
+	var parts []string
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		child := 0
+		for i, part := range node.TextParts {
+			if len(node.textAt) == len(node.TextParts) {
+				for ; child < node.textAt[i] && child < len(node.Children); child++ {
+					walk(node.Children[child])
+				}
+			}
+			parts = append(parts, part)
+		}
+		for ; child < len(node.Children); child++ {
+			walk(node.Children[child])
+		}
+	}
+	walk(node)
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,125 @@
+package nm
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnmarshal(t *testing.T) {
+	nodes, err := ParseString(`
+<div>
+	<h1 class="title">Fruits</h1>
+	<time datetime="2014-03-01">March</time>
+	<ul>
+		<li>apple <b>red</b></li>
+		<li>pear</li>
+	</ul>
+	<table>
+		<tr><td class="name">apple</td><td class="price">1.5</td><td class="count">3</td></tr>
+		<tr><td class="name">pear</td><td class="price">2</td><td class="count">10</td></tr>
+	</table>
+	<a class="next" href="/page/2">next</a>
+</div>
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type Row struct {
+		Name  string  `nm:"td.name"`
+		Price float64 `nm:"td.price"`
+		Count int     `nm:"td.count"`
+	}
+	var page struct {
+		Title   string    `nm:"h1.title"`
+		Next    string    `nm:"a.next@href"`
+		Missing string    `nm:"h2"`
+		Date    time.Time `nm:"time@datetime" layout:"2006-01-02"`
+		Items   []string  `nm:"ul li,text"`
+		Rows    []Row     `nm:"table tr"`
+		First   *Row      `nm:"tr"`
+		Skipped string
+	}
+	if err := Unmarshal(nodes[0], &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Title != "Fruits" || page.Next != "/page/2" || page.Missing != "" {
+		t.Fatalf("strings: %+v", page)
+	}
+	if !page.Date.Equal(time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("time: %v", page.Date)
+	}
+	if strings.Join(page.Items, "|") != "apple red|pear" {
+		t.Fatalf("items: %q", page.Items)
+	}
+	if len(page.Rows) != 2 || page.Rows[0] != (Row{"apple", 1.5, 3}) || page.Rows[1] != (Row{"pear", 2, 10}) {
+		t.Fatalf("rows: %+v", page.Rows)
+	}
+	if page.First == nil || *page.First != page.Rows[0] {
+		t.Fatalf("first: %+v", page.First)
+	}
+
+	// errors name the field
+	var bad struct {
+		Rows []struct {
+			Name  int `nm:"td.name"`
+			Count int `nm:"td.count"`
+		} `nm:"tr"`
+	}
+	err = Unmarshal(nodes[0], &bad)
+	if e, ok := err.(*UnmarshalError); !ok || e.Field != "Rows[0].Name" {
+		t.Fatalf("got %v", err)
+	}
+	var badPattern struct {
+		Title string `nm:"h1["`
+	}
+	err = Unmarshal(nodes[0], &badPattern)
+	if e, ok := err.(*UnmarshalError); !ok || e.Field != "Title" {
+		t.Fatalf("got %v", err)
+	}
+	var badType struct {
+		Title map[string]string `nm:"h1"`
+	}
+	err = Unmarshal(nodes[0], &badType)
+	if e, ok := err.(*UnmarshalError); !ok || e.Field != "Title" {
+		t.Fatalf("got %v", err)
+	}
+	if Unmarshal(nodes[0], page) == nil {
+		t.Fatal("non-pointer")
+	}
+}
+
+func TestDeepText(t *testing.T) {
+	const doc = `<ul><li>apple <b>red</b> ripe <i>and <b>sweet</b></i>!</li><li><b>pear</b></li></ul>`
+	for _, mode := range []ParseMode{Tokenizer, HTML5} {
+		result, err := ParseWithOptions(strings.NewReader(doc), ParseOptions{Mode: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var items []string
+		for _, node := range result.Nodes {
+			for _, li := range Match(node, MustCompile(`... ul > li`)) {
+				items = append(items, deepText(li))
+			}
+		}
+		if strings.Join(items, "|") != "apple red ripe and sweet !|pear" {
+			t.Fatalf("mode %v: got %q", mode, items)
+		}
+	}
+
+	// the text comes from the tree, not from Raw
+	li := &Node{Tag: "li", TextParts: []string{"a"}}
+	li.Children = []*Node{{Parent: li, Tag: "b", TextParts: []string{"b"}}}
+	if text := deepText(li); text != "a b" {
+		t.Fatalf("built by hand: got %q", text)
+	}
+	nodes, err := ParseString(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	li = nodes[0].Children[0]
+	li.Children = li.Children[:1]
+	if text := deepText(li); text != "apple red ripe !" {
+		t.Fatalf("children removed: got %q", text)
+	}
+}
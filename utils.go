@@ -1,7 +1,9 @@
 package nm
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"strings"
 )
 
@@ -10,7 +12,7 @@ var (
 )
 
 func (a *Ast) dump(level int) {
-	pt("%s%s\n", strings.Repeat("  ", level), a.Op.String())
+	pt("%s%s %s\n", strings.Repeat("  ", level), a.Op.String(), a.Name)
 	if a.Left != nil {
 		a.Left.dump(level + 1)
 	}
@@ -18,6 +20,126 @@ func (a *Ast) dump(level int) {
 		a.Right.dump(level + 1)
 	}
 	if a.Predict != nil {
-		pt("%s%v\n", strings.Repeat("  ", level+1), a.Predict)
+		pt("%s%s\n", strings.Repeat("  ", level+1), a.Predict)
 	}
 }
+
+// String returns the ast in pattern syntax, adding parentheses where
+// needed. compiling the result gives an equivalent program.
+func (a *Ast) String() string {
+	if a.Unanchored {
+		return "... " + a.expr()
+	}
+	return a.expr()
+}
+
+func (a *Ast) expr() string {
+	switch a.Op {
+	case opPredict:
+		return a.Predict.alternation()
+	case opStar:
+		return a.Left.elementary() + "*"
+	case opPlus:
+		return a.Left.elementary() + "+"
+	case opOption:
+		return a.Left.elementary() + "?"
+	case opCapture:
+		return a.Left.elementary() + " as " + a.Name
+	case opOr:
+		right := a.Right.expr()
+		if a.Right.isAlternation() {
+			right = "(" + right + ")"
+		}
+		return a.Left.expr() + " | " + right
+	}
+	var combinator string
+	switch a.Op {
+	case opConcat:
+		combinator = " > "
+	case opDescendant:
+		combinator = " "
+	case opNextSibling:
+		combinator = " + "
+	case opFollowingSibling:
+		combinator = " ~ "
+	case opPrevSibling:
+		combinator = " <+ "
+	case opPrecedingSibling:
+		combinator = " <~ "
+	default:
+		return a.Op.String()
+	}
+	left := a.Left.expr()
+	if a.Left.isAlternation() {
+		left = "(" + left + ")"
+	}
+	right := a.Right.basic()
+	if combinator == " " && (right == "as" || strings.HasPrefix(right, "as ")) {
+		right = "(as)" + right[2:] // not the as of a capture
+	}
+	return left + combinator + right
+}
+
+// isAlternation reports whether the ast prints as alternatives, needing
+// parentheses as an operand
+func (a *Ast) isAlternation() bool {
+	return a.Op == opOr || a.Op == opPredict && a.Predict.isAlternation()
+}
+
+// elementary returns the ast as an operand of *, +, ? or as
+func (a *Ast) elementary() string {
+	if a.Op == opPredict && !a.isAlternation() {
+		return a.expr()
+	}
+	return "(" + a.expr() + ")"
+}
+
+// basic returns the ast as the right operand of a combinator
+func (a *Ast) basic() string {
+	switch a.Op {
+	case opStar, opPlus, opOption, opCapture:
+		return a.expr()
+	case opPredict:
+		return a.elementary()
+	}
+	return "(" + a.expr() + ")"
+}
+
+// String returns the disassembly of the program
+func (p Program) String() string {
+	buf := new(bytes.Buffer)
+	p.Disassemble(buf)
+	return buf.String()
+}
+
+// Disassemble writes the program to w, one instruction per line with its
+// address, like
+//
+//	0  Predict          ul
+//	1  Split            2, 4
+func (p Program) Disassemble(w io.Writer) error {
+	for pc, inst := range p {
+		var arg string
+		switch inst.Op {
+		case Predict:
+			if inst.Predict != nil {
+				arg = inst.Predict.String()
+			}
+		case Ok:
+			if inst.A != 0 { // pattern of a set
+				arg = fmt.Sprint(inst.A)
+			}
+		case Jump:
+			arg = fmt.Sprint(inst.A)
+		case Split:
+			arg = fmt.Sprintf("%d, %d", inst.A, inst.B)
+		case Save:
+			arg = inst.Name
+		}
+		line := strings.TrimRight(fmt.Sprintf("%4d  %-16s %s", pc, inst.Op, arg), " ")
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}